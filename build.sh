@@ -1,7 +1,11 @@
 COMMIT=$(git log -1 --format=%h)
 versionflags="${versionflags} -X github.com/m-lab/go/prometheusx.GitShortCommit=${COMMIT}"
 
+# The congestion package does not use cgo, so we can build fully static
+# binaries without a C toolchain.
+export CGO_ENABLED=0
+
 go build -v                                                           \
     -tags netgo                                                        \
     -ldflags "$versionflags -extldflags \"-static\""                   \
-    ./cmd/msak-server
+    -o ./ ./cmd/msak-server ./cmd/msak-client ./cmd/msak-sign ./cmd/msak-join ./cmd/msak-convert
@@ -2,19 +2,27 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 	"github.com/m-lab/go/warnonerror"
 	"github.com/m-lab/locate/api/locate"
 	v2 "github.com/m-lab/locate/api/v2"
-	"github.com/m-lab/uuid"
+	"github.com/robertodauria/msak/client/config"
+	"github.com/robertodauria/msak/client/emitter"
+	"github.com/robertodauria/msak/client/schedule"
 	"github.com/robertodauria/msak/internal/congestion"
 	"github.com/robertodauria/msak/internal/netx"
 	"github.com/robertodauria/msak/internal/persistence"
@@ -39,6 +47,9 @@ const (
 var (
 	// ErrNoTargets is returned if all Locate targets have been tried.
 	ErrNoTargets = errors.New("no targets available")
+
+	// ErrNoStreams is returned if none of the streams could be started.
+	ErrNoStreams = errors.New("no streams completed")
 )
 
 type Locator interface {
@@ -64,10 +75,46 @@ type NDTMClient struct {
 	CongestionControl string
 	MeasurementID     string
 
-	OutputPath    string
-	ResultsByUUID map[string]*results.NDTMResult
-
-	// targets and tIndex cache the results from the Locate API.
+	// ClockSyncSamples is the number of exchanges used to estimate the
+	// offset between the client's and the server's clocks at the beginning
+	// of each stream. Zero disables the estimation, which is also skipped
+	// with servers not confirming it. If it fails, the stream fails.
+	ClockSyncSamples int
+
+	// Encoding is the encoding requested for the measurement messages
+	// exchanged with the server. The server can refuse it and use
+	// ndtm.EncodingJSON instead.
+	Encoding ndtm.Encoding
+
+	// Delivery defines how the measurements of each stream are buffered.
+	// With DeliveryDrop, the measurements not fitting in the buffer are
+	// counted in the results' DroppedMeasurements.
+	Delivery ndtm.DeliveryPolicy
+
+	// Schedule optionally specifies when each stream starts and how long it
+	// lasts. When nil, NumStreams streams are started Delay apart from each
+	// other and all end Length after the beginning of the measurement.
+	Schedule schedule.Schedule
+
+	// StreamsCongestionControl optionally specifies a congestion control
+	// algorithm for each stream: stream i uses element i modulo its length.
+	// When empty, all the streams use CongestionControl.
+	StreamsCongestionControl []string
+
+	OutputPath string
+
+	// OutputFormat is the format results are written to OutputPath in:
+	// "json" (the default) or "compact".
+	OutputFormat string
+
+	// Emitter receives the events of each measurement. It must not be nil.
+	// Emitters implementing emitter.ProgressEmitter also receive the
+	// aggregate progress of the measurement.
+	Emitter emitter.Emitter
+
+	// mu protects targets and tIndex, which cache the results from the
+	// Locate API.
+	mu      sync.Mutex
 	targets []v2.Target
 	tIndex  map[string]int
 }
@@ -84,8 +131,12 @@ func New(clientName, clientVersion string) *NDTMClient {
 		Dialer: &websocket.Dialer{
 			HandshakeTimeout: DefaultWebSocketHandshakeTimeout,
 		},
-		ResultsByUUID: make(map[string]*results.NDTMResult),
-		Scheme:        "wss",
+		Scheme:           "wss",
+		ClockSyncSamples: spec.DefaultClockSyncSamples,
+		Encoding:         ndtm.EncodingJSON,
+		OutputFormat:     string(persistence.FormatJSON),
+		Delivery:         ndtm.DefaultDeliveryPolicy,
+		Emitter:          &emitter.LogEmitter{},
 		Locate: locate.NewClient(
 			makeUserAgent(clientName, clientVersion),
 		),
@@ -93,7 +144,93 @@ func New(clientName, clientVersion string) *NDTMClient {
 	}
 }
 
-func (c *NDTMClient) connect(ctx context.Context, serviceURL *url.URL) (*websocket.Conn, error) {
+// NewWithConfig returns a new client configured according to cfg.
+func NewWithConfig(clientName, clientVersion string,
+	cfg *config.ClientConfig) (*NDTMClient, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	c := New(clientName, clientVersion)
+	c.Scheme = string(cfg.Scheme)
+	c.Server = cfg.Server
+	if cfg.ServiceURL != "" {
+		u, err := url.Parse(cfg.ServiceURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service URL: %w", err)
+		}
+		c.ServiceURL = u
+	}
+	c.NumStreams = cfg.Streams
+	c.Length = cfg.Duration
+	c.Delay = cfg.StreamsDelay
+	switch {
+	case cfg.Schedule != "":
+		s, err := schedule.Parse(cfg.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule: %w", err)
+		}
+		c.Schedule = s
+	case cfg.ScheduleFile != "":
+		s, err := schedule.Load(cfg.ScheduleFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule file: %w", err)
+		}
+		c.Schedule = s
+	}
+	if ccs := strings.Split(cfg.CongestionControl, ","); len(ccs) > 1 {
+		c.StreamsCongestionControl = ccs
+	} else {
+		c.CongestionControl = cfg.CongestionControl
+	}
+	c.OutputPath = cfg.OutputPath
+	c.OutputFormat = cfg.OutputFormat
+	c.ClockSyncSamples = cfg.ClockSyncSamples
+	c.Delivery = cfg.DeliveryPolicy()
+	c.Encoding = ndtm.Encoding(cfg.Encoding)
+
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.Dialer.TLSClientConfig = tlsConfig
+	return c, nil
+}
+
+// newTLSConfig returns the TLS configuration for the client's dialer.
+func newTLSConfig(cfg *config.ClientConfig) (*tls.Config, error) {
+	minVersion, err := cfg.MinVersion()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.NoVerify,
+		ServerName:         cfg.ServerName,
+		MinVersion:         minVersion,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// connect dials serviceURL and returns the connection and the headers of the
+// server's upgrade response.
+func (c *NDTMClient) connect(ctx context.Context, serviceURL *url.URL) (*websocket.Conn, http.Header, error) {
 	q := serviceURL.Query()
 	q.Set("client_arch", runtime.GOARCH)
 	q.Set("client_library_name", libraryName)
@@ -105,8 +242,11 @@ func (c *NDTMClient) connect(ctx context.Context, serviceURL *url.URL) (*websock
 	headers := http.Header{}
 	headers.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
 	headers.Add("User-Agent", makeUserAgent(c.ClientName, c.ClientVersion))
-	conn, _, err := c.Dialer.DialContext(ctx, serviceURL.String(), headers)
-	return conn, err
+	conn, resp, err := c.Dialer.DialContext(ctx, serviceURL.String(), headers)
+	if err != nil {
+		return nil, nil, handshakeError(resp, err)
+	}
+	return conn, resp.Header, nil
 }
 
 // nextURLFromLocate returns the next URL to try from the Locate API.
@@ -114,6 +254,8 @@ func (c *NDTMClient) connect(ctx context.Context, serviceURL *url.URL) (*websock
 // API. Subsequently, it returns the next URL from the cache.
 // If there are no more URLs to try, it returns an error.
 func (c *NDTMClient) nextURLFromLocate(ctx context.Context, p string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if len(c.targets) == 0 {
 		targets, err := c.Locate.Nearest(ctx, "msak/ndtm")
 		if err != nil {
@@ -132,7 +274,13 @@ func (c *NDTMClient) nextURLFromLocate(ctx context.Context, p string) (string, e
 	return "", ErrNoTargets
 }
 
-func (c *NDTMClient) start(ctx context.Context, subtest spec.SubtestKind) error {
+func (c *NDTMClient) start(ctx context.Context, subtest spec.SubtestKind) (*Run, error) {
+	// Each run has its own measurement ID, unless one has been provided.
+	mid := c.MeasurementID
+	if mid == "" {
+		mid = uuid.NewString()
+	}
+
 	// Find the URL to use for this measurement.
 	var mURL *url.URL
 	// If the server has been provided, use it and use default paths based on
@@ -146,15 +294,13 @@ func (c *NDTMClient) start(ctx context.Context, subtest spec.SubtestKind) error
 			Path:   path,
 		}
 		q := mURL.Query()
-		q.Set("mid", c.MeasurementID)
+		q.Set("mid", mid)
 		mURL.RawQuery = q.Encode()
 	}
 
 	// If a service URL was provided, use it as-is.
 	if c.ServiceURL != nil {
 		zap.L().Sugar().Info("using service url ", c.ServiceURL.String())
-		// Override scheme to match the provided service url.
-		c.Scheme = c.ServiceURL.Scheme
 		mURL = c.ServiceURL
 	}
 
@@ -163,24 +309,61 @@ func (c *NDTMClient) start(ctx context.Context, subtest spec.SubtestKind) error
 		zap.L().Sugar().Info("using locate")
 		urlStr, err := c.nextURLFromLocate(ctx, getPathForSubtest(subtest))
 		if err != nil {
-			return err
+			return nil, err
 		}
 		mURL, err = url.Parse(urlStr)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		zap.L().Sugar().Info("URL: ", mURL.String())
 	}
 
-	wg := &sync.WaitGroup{}
-	globalTimeout, cancel := context.WithTimeout(ctx, c.Length)
-	defer cancel()
+	sched, err := c.schedule()
+	if err != nil {
+		return nil, err
+	}
+
+	run := &Run{
+		MeasurementID: mid,
+		SubTest:       subtest,
+		StartTime:     time.Now().UTC(),
+		Streams:       make([]*results.NDTMResult, len(sched)),
+		Errors:        make([]error, len(sched)),
+	}
+
+	prog := newProgress(run.StartTime, len(sched))
 
-	for i := 0; i < c.NumStreams; i++ {
+	// Each stream only writes to its own element of run.Streams and
+	// run.Errors, so no locking is needed until wg.Wait() returns.
+	wg := &sync.WaitGroup{}
+	for i, st := range sched {
 		wg.Add(2)
-		measurements := make(chan results.Measurement)
+		i, st := i, st
+		fail := func(err error) {
+			run.Errors[i] = err
+			c.Emitter.OnError(subtest, fmt.Errorf("stream #%d: %w", i, err))
+		}
+		cc := c.congestionControl(i)
+		// Each stream gets its own copy of the URL, since the querystring
+		// depends on the stream's congestion control algorithm.
+		streamURL := *mURL
+		// For downloads the server is the sender, so the congestion control
+		// algorithm must be requested to the server. For uploads, it is set
+		// on the client's socket once connected.
+		q := streamURL.Query()
+		if subtest == spec.SubtestDownload && cc != "" {
+			q.Set("cc", cc)
+		}
+		if c.ClockSyncSamples > 0 {
+			q.Set(spec.ClockSyncParam, strconv.Itoa(c.ClockSyncSamples))
+		}
+		if c.Encoding != "" && c.Encoding != ndtm.EncodingJSON {
+			q.Set(spec.EncodingParam, string(c.Encoding))
+		}
+		streamURL.RawQuery = q.Encode()
+		measurements := ndtm.NewMeasurements(c.Delivery)
 		result := &results.NDTMResult{
-			MeasurementID:      c.MeasurementID,
+			MeasurementID:      mid,
 			SubTest:            string(subtest),
 			ServerMeasurements: make([]results.Measurement, 0),
 			ClientMeasurements: make([]results.Measurement, 0),
@@ -188,68 +371,151 @@ func (c *NDTMClient) start(ctx context.Context, subtest spec.SubtestKind) error
 
 		go func() {
 			defer wg.Done()
-			zap.L().Sugar().Debug("connecting to ", mURL.String())
-			// Connect to mURL.
-			conn, err := c.connect(ctx, mURL)
+			// Wait until it's time to start this stream.
+			timer := time.NewTimer(st.Start)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				measurements.Close()
+				fail(ctx.Err())
+				return
+			case <-timer.C:
+			}
+			zap.L().Sugar().Debug("connecting to ", streamURL.String())
+			// Connect to streamURL.
+			conn, header, err := c.connect(ctx, &streamURL)
 			if err != nil {
-				zap.L().Sugar().Error(err)
-				close(measurements)
+				measurements.Close()
+				fail(err)
 				return
 			}
-			// To store measurement results we use a map associating the
-			// TCP flow's unique identifier to the corresponding results.
-			info, err := getConnInfo(conn)
+			// For uploads the client is the sender, so the congestion
+			// control algorithm must be set on the local socket. In case of
+			// failure, the measurement continues with the current one.
+			if subtest == spec.SubtestUpload && cc != "" {
+				if err := setCC(conn, cc); err != nil {
+					zap.L().Sugar().Errorf("Cannot enable cc %s: %v", cc, err)
+				}
+			}
+			info, err := ndtm.GetConnInfo(conn, false)
 			if err != nil {
-				zap.L().Sugar().Error(err)
+				conn.Close()
+				measurements.Close()
+				fail(err)
 				return
 			}
 
+			info.Extensions = ndtm.Extensions(header)
+			enc := ndtm.NegotiatedEncoding(header)
 			result.UUID = info.UUID
+			// Servers not sending their UUID in the upgrade response still
+			// report it in their measurements.
+			result.PeerUUID = header.Get(spec.UUIDHeader)
 			result.CongestionControl = info.CC
+			result.TLS = info.TLS
+			// Only estimate the clock offset if the server confirmed it will
+			// answer. A failed estimation leaves the connection unusable.
+			if n := ndtm.NegotiatedClockSync(header); c.ClockSyncSamples > 0 && n > 0 {
+				cs, err := ndtm.EstimateClockOffset(conn, n)
+				if err != nil {
+					conn.Close()
+					measurements.Close()
+					fail(fmt.Errorf("clock offset estimation failed: %w", err))
+					return
+				}
+				result.ClockSync = cs
+			}
 			result.StartTime = time.Now().UTC()
-			c.ResultsByUUID[info.UUID] = result
-
+			run.Streams[i] = result
+			prog.start()
+			c.Emitter.OnStart(subtest, i)
+
+			// The stream lasts st.Duration from when the connection is
+			// established.
+			streamCtx, cancel := context.WithTimeout(ctx, st.Duration)
+			defer cancel()
 			switch subtest {
 			case spec.SubtestDownload:
-				err = ndtm.Receiver(globalTimeout, conn, info, measurements)
+				err = ndtm.Receiver(streamCtx, conn, info, enc, measurements)
 			case spec.SubtestUpload:
-				err = ndtm.Sender(globalTimeout, conn, info, measurements)
+				err = ndtm.Sender(streamCtx, conn, info, enc, measurements)
 			}
 
 			if err != nil {
-				zap.L().Sugar().Error(err)
+				fail(closeError(err))
 			}
 
 			result.EndTime = time.Now().UTC()
+			prog.complete()
+			c.Emitter.OnComplete(subtest, i)
 		}()
 
 		go func() {
 			defer wg.Done()
-			c.measurer(result, measurements)
+			c.measurer(i, result, measurements, prog)
 		}()
-
-		time.Sleep(c.Delay)
 	}
 
 	wg.Wait()
+	run.EndTime = time.Now().UTC()
+	run.Summary = summarize(run.Streams)
 
 	// If an output path was specified, write the results as JSON.
 	if c.OutputPath != "" {
-		for uuid, v := range c.ResultsByUUID {
-			c.writeResult(uuid, subtest, v)
+		for _, r := range run.Streams {
+			if r != nil {
+				c.writeResult(r.UUID, subtest, r)
+			}
 		}
 	}
+	if run.Summary.Streams == 0 {
+		return run, ErrNoStreams
+	}
+	return run, nil
+}
 
-	return nil
+// schedule returns the measurement's schedule: Schedule if set, otherwise
+// NumStreams streams started Delay apart from each other and all ending
+// Length after the beginning of the measurement.
+func (c *NDTMClient) schedule() (schedule.Schedule, error) {
+	s := c.Schedule
+	if s == nil {
+		if c.NumStreams > schedule.MaxStreams {
+			return nil, schedule.ErrTooManyStreams
+		}
+		s = schedule.Ramp(c.NumStreams, c.Delay, c.Length)
+	}
+	return s, s.Validate()
+}
+
+// congestionControl returns the congestion control algorithm for the i-th
+// stream.
+func (c *NDTMClient) congestionControl(i int) string {
+	if len(c.StreamsCongestionControl) > 0 {
+		return c.StreamsCongestionControl[i%len(c.StreamsCongestionControl)]
+	}
+	return c.CongestionControl
 }
 
-func (c *NDTMClient) measurer(result *results.NDTMResult, measurements chan results.Measurement) {
-	for m := range measurements {
+// measurer stores the measurements of the i-th stream in result and emits
+// them, along with the aggregate progress of the run.
+func (c *NDTMClient) measurer(i int, result *results.NDTMResult, measurements *ndtm.Measurements,
+	prog *progress) {
+	kind := spec.SubtestKind(result.SubTest)
+	for m := range measurements.C {
 		zap.L().Sugar().Debugw("Measurement received", "origin", m.Origin, "AppInfo", m.AppInfo)
+		c.Emitter.OnMeasurement(kind, i, m)
+		if m.Origin == "receiver" && m.AppInfo != nil {
+			p := prog.update(i, m.AppInfo.NumBytes)
+			if pe, ok := c.Emitter.(emitter.ProgressEmitter); ok {
+				pe.OnProgress(kind, p)
+			}
+		}
 		switch result.SubTest {
 		case string(spec.SubtestDownload):
 			if m.Origin == "sender" {
 				result.ServerMeasurements = append(result.ServerMeasurements, m)
+				ndtm.RecordPeer(m, &result.ServerCongestionControl, &result.PeerUUID)
 			} else {
 				result.ClientMeasurements = append(result.ClientMeasurements, m)
 			}
@@ -258,23 +524,40 @@ func (c *NDTMClient) measurer(result *results.NDTMResult, measurements chan resu
 				result.ClientMeasurements = append(result.ClientMeasurements, m)
 			} else {
 				result.ServerMeasurements = append(result.ServerMeasurements, m)
+				ndtm.RecordPeer(m, &result.ServerCongestionControl, &result.PeerUUID)
 			}
 		}
 	}
+	result.DroppedMeasurements = measurements.Dropped()
+	result.InvalidMeasurements = measurements.Invalid()
+	result.ByteDivergence = ndtm.ComputeByteDivergence(result)
 }
 
-func (c *NDTMClient) Download(ctx context.Context) {
-	err := c.start(ctx, spec.SubtestDownload)
-	if err != nil {
-		zap.L().Sugar().Error(err)
-	}
+// Download runs a download measurement and returns its Run. It returns an
+// error if the measurement could not be started or none of its streams
+// completed; errors of individual streams are reported in Run.Errors.
+//
+// It is safe to call Download and Upload concurrently on the same client.
+func (c *NDTMClient) Download(ctx context.Context) (*Run, error) {
+	return c.run(ctx, spec.SubtestDownload)
 }
 
-func (c *NDTMClient) Upload(ctx context.Context) {
-	err := c.start(ctx, spec.SubtestUpload)
+// Upload runs an upload measurement and returns its Run. It returns an error
+// if the measurement could not be started or none of its streams completed;
+// errors of individual streams are reported in Run.Errors.
+//
+// It is safe to call Download and Upload concurrently on the same client.
+func (c *NDTMClient) Upload(ctx context.Context) (*Run, error) {
+	return c.run(ctx, spec.SubtestUpload)
+}
+
+// run runs the given subtest and reports a failure to the emitter.
+func (c *NDTMClient) run(ctx context.Context, subtest spec.SubtestKind) (*Run, error) {
+	r, err := c.start(ctx, subtest)
 	if err != nil {
-		zap.L().Sugar().Error(err)
+		c.Emitter.OnError(subtest, err)
 	}
+	return r, err
 }
 
 func getPathForSubtest(subtest spec.SubtestKind) string {
@@ -288,31 +571,19 @@ func getPathForSubtest(subtest spec.SubtestKind) string {
 	}
 }
 
-// Return a ConnectionInfo struct for the given websocket connection.
-func getConnInfo(conn *websocket.Conn) (*results.ConnectionInfo, error) {
-	fp, err := netx.GetFile(conn.UnderlyingConn())
-	if err != nil {
-		return nil, err
-	}
-	cc, err := congestion.Get(fp)
+// setCC sets the congestion control algorithm for the given websocket
+// connection.
+func setCC(conn *websocket.Conn, cc string) error {
+	rc, err := netx.GetRawConn(conn.UnderlyingConn())
 	if err != nil {
-		return nil, err
-	}
-	// Get UUID for this TCP flow.
-	uuid, err := uuid.FromFile(fp)
-	if err != nil {
-		return nil, err
+		return err
 	}
-	return &results.ConnectionInfo{
-		UUID:   uuid,
-		Client: conn.RemoteAddr().String(),
-		Server: conn.RemoteAddr().String(),
-		CC:     cc,
-	}, nil
+	return congestion.Set(rc, cc)
 }
 
 func (c *NDTMClient) writeResult(uuid string, kind spec.SubtestKind, result *results.NDTMResult) {
-	fp, err := persistence.New(c.OutputPath, string(kind), uuid)
+	fp, err := persistence.New(c.OutputPath, string(kind), uuid,
+		persistence.Format(c.OutputFormat))
 	if err != nil {
 		zap.L().Sugar().Error("results.NewFile failed", err)
 		return
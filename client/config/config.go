@@ -1,41 +1,128 @@
 package config
 
-import "time"
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/robertodauria/msak/internal/persistence"
+	"github.com/robertodauria/msak/pkg/ndtm"
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+	"gopkg.in/yaml.v3"
+)
 
 type DialerScheme string
 
 const (
 	WebSocketSecure DialerScheme = "wss"
-	WebSocket                    = "ws"
+	WebSocket       DialerScheme = "ws"
 )
 
 const (
 	defaultScheme      = WebSocketSecure
+	defaultStreams     = 5
 	defaultDuration    = 10 * time.Second
 	defaultStreamDelay = 0
 	defaultCC          = "bbr"
+
+	// DefaultProfile is the name of the profile used when none is specified.
+	DefaultProfile = "default"
+)
+
+var (
+	// ErrNoProfile is returned if the requested profile is not in the file.
+	ErrNoProfile = errors.New("profile not found")
+
+	// ErrInvalidScheme is returned if the configured scheme is not ws or wss.
+	ErrInvalidScheme = errors.New("invalid scheme")
+
+	// ErrInvalidTLSVersion is returned if TLSMinVersion is not a known
+	// TLS version.
+	ErrInvalidTLSVersion = errors.New("invalid TLS version")
 )
 
 type ClientConfig struct {
 	// The scheme to use (ws/wss).
-	Scheme DialerScheme
+	Scheme DialerScheme `yaml:"scheme"`
+
+	// The server to connect to (host:port). If empty, the Locate API is used.
+	Server string `yaml:"server"`
+
+	// The full URL to connect to. Takes precedence over Server and Scheme.
+	ServiceURL string `yaml:"service_url"`
+
+	// The number of streams.
+	Streams int `yaml:"streams"`
 
 	// The default Duration of a measurement.
-	Duration time.Duration
+	Duration time.Duration `yaml:"duration"`
 
 	// The delay between stream starts.
-	StreamsDelay time.Duration
+	StreamsDelay time.Duration `yaml:"streams_delay"`
+
+	// Per-stream schedule, in the format accepted by schedule.Parse. Takes
+	// precedence over Streams, Duration and StreamsDelay.
+	Schedule string `yaml:"schedule"`
+
+	// File to read the per-stream schedule from, in the format accepted by
+	// schedule.Load. Schedule takes precedence over it.
+	ScheduleFile string `yaml:"schedule_file"`
+
+	// Congestion control algorithm to request to the server. A
+	// comma-separated list assigns one algorithm to each stream.
+	CongestionControl string `yaml:"congestion_control"`
+
+	// Path to write measurement results to.
+	OutputPath string `yaml:"output_path"`
+
+	// Format to write measurement results in ("json" or "compact").
+	OutputFormat string `yaml:"output_format"`
+
+	// Number of exchanges to estimate the clock offset from the server with
+	// at the beginning of each stream (0 to disable).
+	ClockSyncSamples int `yaml:"clock_sync_samples"`
+
+	// Number of measurements buffered for each stream.
+	MeasurementBuffer int `yaml:"measurement_buffer"`
+
+	// What to do with measurements when the buffer is full ("drop" or
+	// "block").
+	Delivery string `yaml:"delivery"`
+
+	// Encoding to request for measurement messages ("json" or "cbor").
+	Encoding string `yaml:"encoding"`
 
 	// Ignore invalid TLS certs.
-	NoVerify bool
+	NoVerify bool `yaml:"no_verify"`
+
+	// PEM file containing the CAs to verify the server's certificate with,
+	// instead of the system ones.
+	CAFile string `yaml:"ca_file"`
 
-	// Congestion control algorithm to request to the server.
-	CongestionControl string
+	// Server name to send via SNI and to verify the server's certificate
+	// against, instead of the host being connected to.
+	ServerName string `yaml:"server_name"`
+
+	// Minimum TLS version to accept ("1.0", "1.1", "1.2" or "1.3"). If empty,
+	// the crypto/tls default is used.
+	TLSMinVersion string `yaml:"tls_min_version"`
+
+	// PEM files containing the certificate and key to present to the server.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
 }
 
 func New(scheme DialerScheme, duration, delay time.Duration, cc string) *ClientConfig {
 	return &ClientConfig{
 		Scheme:            scheme,
+		Streams:           defaultStreams,
+		ClockSyncSamples:  spec.DefaultClockSyncSamples,
+		MeasurementBuffer: ndtm.DefaultDeliveryPolicy.BufferSize,
+		Delivery:          string(ndtm.DefaultDeliveryPolicy.Mode),
+		Encoding:          string(ndtm.EncodingJSON),
+		OutputFormat:      string(persistence.FormatJSON),
 		Duration:          duration,
 		StreamsDelay:      delay,
 		CongestionControl: cc,
@@ -45,3 +132,106 @@ func New(scheme DialerScheme, duration, delay time.Duration, cc string) *ClientC
 func NewDefault() *ClientConfig {
 	return New(defaultScheme, defaultDuration, defaultStreamDelay, defaultCC)
 }
+
+// Validate checks that the configuration makes sense.
+func (c *ClientConfig) Validate() error {
+	if c.Scheme != WebSocket && c.Scheme != WebSocketSecure {
+		return fmt.Errorf("%w: %q", ErrInvalidScheme, c.Scheme)
+	}
+	if c.Schedule == "" && c.ScheduleFile == "" && (c.Streams <= 0 || c.Duration <= 0) {
+		return errors.New("streams and duration must be positive")
+	}
+	if c.StreamsDelay < 0 {
+		return errors.New("streams delay must not be negative")
+	}
+	if c.ClockSyncSamples < 0 || c.ClockSyncSamples > spec.MaxClockSyncSamples {
+		return fmt.Errorf("clock sync samples must be between 0 and %d",
+			spec.MaxClockSyncSamples)
+	}
+	if err := c.DeliveryPolicy().Validate(); err != nil {
+		return err
+	}
+	if _, err := persistence.ParseFormat(c.OutputFormat); err != nil {
+		return err
+	}
+	if _, err := ndtm.ParseEncoding(c.Encoding); err != nil {
+		return err
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("cert file and key file must be set together")
+	}
+	if _, err := c.MinVersion(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeliveryPolicy returns the policy for delivering measurements.
+func (c *ClientConfig) DeliveryPolicy() ndtm.DeliveryPolicy {
+	return ndtm.DeliveryPolicy{
+		BufferSize: c.MeasurementBuffer,
+		Mode:       ndtm.DeliveryMode(c.Delivery),
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// MinVersion returns the crypto/tls constant for TLSMinVersion, or zero if
+// TLSMinVersion is empty.
+func (c *ClientConfig) MinVersion() (uint16, error) {
+	if c.TLSMinVersion == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[c.TLSMinVersion]
+	if !ok {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidTLSVersion, c.TLSMinVersion)
+	}
+	return v, nil
+}
+
+// Load reads the named profile from a YAML or JSON file, whose top-level keys
+// are the profile names. An empty name selects DefaultProfile. Fields missing
+// from the profile keep their default values. Durations are strings in the
+// time.ParseDuration format, e.g.:
+//
+//	default:
+//	  server: localhost:8080
+//	  scheme: ws
+//	  streams: 3
+//	  duration: 5s
+func Load(path, name string) (*ClientConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b, name)
+}
+
+// Parse is like Load but reads the profiles from b.
+func Parse(b []byte, name string) (*ClientConfig, error) {
+	if name == "" {
+		name = DefaultProfile
+	}
+	// YAML is a superset of JSON, so this handles both formats.
+	profiles := map[string]yaml.Node{}
+	if err := yaml.Unmarshal(b, &profiles); err != nil {
+		return nil, err
+	}
+	node, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNoProfile, name)
+	}
+	c := NewDefault()
+	if err := node.Decode(c); err != nil {
+		return nil, fmt.Errorf("profile %q: %w", name, err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, fmt.Errorf("profile %q: %w", name, err)
+	}
+	return c, nil
+}
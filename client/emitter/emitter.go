@@ -1,11 +1,17 @@
 package emitter
 
 import (
+	"time"
+
 	"github.com/robertodauria/msak/pkg/ndtm/results"
 	"github.com/robertodauria/msak/pkg/ndtm/spec"
 	"go.uber.org/zap"
 )
 
+// Emitter receives the events of a measurement. Streams are identified by
+// their index in the measurement's schedule. Methods are called concurrently
+// from the goroutines handling each stream, so implementations must be safe
+// for concurrent use.
 type Emitter interface {
 	OnMeasurement(spec.SubtestKind, int, results.Measurement)
 	OnError(spec.SubtestKind, error)
@@ -13,6 +19,26 @@ type Emitter interface {
 	OnComplete(spec.SubtestKind, int)
 }
 
+// ProgressEmitter is an Emitter that also receives the aggregate progress of
+// a measurement, each time a receiver's measurement is taken.
+type ProgressEmitter interface {
+	Emitter
+	OnProgress(spec.SubtestKind, Progress)
+}
+
+// Progress is the aggregate progress of a measurement across its streams,
+// based on the receivers' measurements.
+type Progress struct {
+	// Elapsed is the time since the beginning of the measurement.
+	Elapsed time.Duration
+	// ActiveStreams is the number of streams currently running.
+	ActiveStreams int
+	// NumBytes is the number of bytes received so far by all the streams.
+	NumBytes int64
+	// Throughput is the aggregate throughput so far in Mb/s.
+	Throughput float64
+}
+
 type LogEmitter struct{}
 
 func (e *LogEmitter) OnMeasurement(kind spec.SubtestKind, n int, m results.Measurement) {
@@ -31,3 +57,7 @@ func (e *LogEmitter) OnStart(kind spec.SubtestKind, n int) {
 func (e *LogEmitter) OnComplete(kind spec.SubtestKind, n int) {
 	zap.L().Sugar().Infof("%s: completed stream #%d", kind, n)
 }
+func (e *LogEmitter) OnProgress(kind spec.SubtestKind, p Progress) {
+	zap.L().Sugar().Infof("%s: aggregate throughput: %f Mb/s (%d streams)", kind,
+		p.Throughput, p.ActiveStreams)
+}
@@ -0,0 +1,129 @@
+package emitter
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+)
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	EventStart       = EventType("start")
+	EventMeasurement = EventType("measurement")
+	EventError       = EventType("error")
+	EventComplete    = EventType("complete")
+	EventProgress    = EventType("progress")
+)
+
+// Event is the serializable form of a call to an Emitter method.
+type Event struct {
+	Type    EventType
+	SubTest spec.SubtestKind
+	// Stream is the index of the stream for start, measurement and complete
+	// events.
+	Stream      int
+	Measurement *results.Measurement `json:",omitempty"`
+	Progress    *Progress            `json:",omitempty"`
+	// Error is the error message for error events. Err holds the original
+	// error, which is not serialized.
+	Error string `json:",omitempty"`
+	Err   error  `json:"-"`
+}
+
+// eventEmitter implements Emitter by converting each call to an Event and
+// passing it to emit.
+type eventEmitter struct {
+	emit func(Event)
+}
+
+func (e eventEmitter) OnMeasurement(kind spec.SubtestKind, n int, m results.Measurement) {
+	e.emit(Event{Type: EventMeasurement, SubTest: kind, Stream: n, Measurement: &m})
+}
+
+func (e eventEmitter) OnError(kind spec.SubtestKind, err error) {
+	e.emit(Event{Type: EventError, SubTest: kind, Error: err.Error(), Err: err})
+}
+
+func (e eventEmitter) OnStart(kind spec.SubtestKind, n int) {
+	e.emit(Event{Type: EventStart, SubTest: kind, Stream: n})
+}
+
+func (e eventEmitter) OnComplete(kind spec.SubtestKind, n int) {
+	e.emit(Event{Type: EventComplete, SubTest: kind, Stream: n})
+}
+
+func (e eventEmitter) OnProgress(kind spec.SubtestKind, p Progress) {
+	e.emit(Event{Type: EventProgress, SubTest: kind, Progress: &p})
+}
+
+// JSONEmitter writes each event as a line of JSON to an io.Writer.
+type JSONEmitter struct {
+	eventEmitter
+
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewJSONEmitter returns a JSONEmitter writing to w.
+func NewJSONEmitter(w io.Writer) *JSONEmitter {
+	e := &JSONEmitter{
+		enc: json.NewEncoder(w),
+	}
+	e.eventEmitter = eventEmitter{emit: e.write}
+	return e
+}
+
+func (e *JSONEmitter) write(ev Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.err != nil {
+		return
+	}
+	e.err = e.enc.Encode(ev)
+}
+
+// Err returns the first error encountered writing events, if any. Events
+// are not written after an error.
+func (e *JSONEmitter) Err() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.err
+}
+
+// ChannelEmitter sends each event over a channel. To avoid stalling the
+// measurement, events are dropped when the channel is full.
+type ChannelEmitter struct {
+	eventEmitter
+
+	// C is the channel events are sent over. It is never closed.
+	C <-chan Event
+
+	dropped int64
+}
+
+// NewChannelEmitter returns a ChannelEmitter whose channel has the given
+// buffer size.
+func NewChannelEmitter(size int) *ChannelEmitter {
+	c := make(chan Event, size)
+	e := &ChannelEmitter{C: c}
+	e.eventEmitter = eventEmitter{emit: func(ev Event) {
+		select {
+		case c <- ev:
+		default:
+			atomic.AddInt64(&e.dropped, 1)
+		}
+	}}
+	return e
+}
+
+// Dropped returns the number of events dropped because the channel was full.
+func (e *ChannelEmitter) Dropped() int64 {
+	return atomic.LoadInt64(&e.dropped)
+}
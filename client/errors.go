@@ -0,0 +1,104 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+)
+
+// Errors reported by the server, either by refusing the WebSocket upgrade or
+// by closing the connection with an ndt-m close code. They can be matched
+// with errors.Is against a HandshakeError or a CloseError.
+var (
+	ErrUnsupportedCC    = errors.New("congestion control algorithm not supported by the server")
+	ErrServerOverloaded = errors.New("server overloaded")
+	ErrDurationExceeded = errors.New("maximum measurement duration exceeded")
+	ErrServerInternal   = errors.New("internal server error")
+	ErrUnauthorized     = errors.New("not authorized by the server")
+	ErrOriginNotAllowed = errors.New("origin not allowed by the server")
+)
+
+// closeCodeErrors maps ndt-m close codes to the corresponding errors.
+var closeCodeErrors = map[int]error{
+	spec.CloseUnsupportedCC:    ErrUnsupportedCC,
+	spec.CloseServerOverloaded: ErrServerOverloaded,
+	spec.CloseDurationExceeded: ErrDurationExceeded,
+	spec.CloseInternalError:    ErrServerInternal,
+}
+
+// CloseError is returned when the server closes the connection with an
+// ndt-m close code.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("server closed the connection: %s (%d)", e.Reason, e.Code)
+}
+
+// Is reports whether target is the error corresponding to e's close code.
+func (e *CloseError) Is(target error) bool {
+	return closeCodeErrors[e.Code] == target
+}
+
+// HandshakeError is returned when the server refuses the WebSocket upgrade.
+type HandshakeError struct {
+	StatusCode int
+	// AvailableCC lists the congestion control algorithms accepted by the
+	// server, if it refused the requested ones.
+	AvailableCC []string
+}
+
+func (e *HandshakeError) Error() string {
+	msg := fmt.Sprintf("websocket handshake failed: %d %s", e.StatusCode,
+		http.StatusText(e.StatusCode))
+	if len(e.AvailableCC) > 0 {
+		msg += fmt.Sprintf(" (available cc: %s)", strings.Join(e.AvailableCC, ","))
+	}
+	return msg
+}
+
+// Is reports whether target is the error corresponding to e's status code.
+func (e *HandshakeError) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return target == ErrUnsupportedCC && e.AvailableCC != nil
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrOriginNotAllowed
+	case http.StatusServiceUnavailable, http.StatusTooManyRequests:
+		return target == ErrServerOverloaded
+	}
+	return false
+}
+
+// handshakeError returns a HandshakeError for a failed upgrade, if the server
+// sent a response, or err.
+func handshakeError(resp *http.Response, err error) error {
+	if resp == nil || !errors.Is(err, websocket.ErrBadHandshake) {
+		return err
+	}
+	e := &HandshakeError{StatusCode: resp.StatusCode}
+	if available := resp.Header.Get(spec.AvailableCCHeader); available != "" {
+		e.AvailableCC = strings.Split(available, ",")
+	}
+	return e
+}
+
+// closeError returns a CloseError if err is a close message with an ndt-m
+// close code, or err.
+func closeError(err error) error {
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		if _, ok := closeCodeErrors[ce.Code]; ok {
+			return &CloseError{Code: ce.Code, Reason: ce.Text}
+		}
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+// Package fairness computes how the throughput of a multi-stream measurement
+// was shared among its streams and their congestion control algorithms.
+package fairness
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+)
+
+var (
+	// ErrNotEnoughStreams is returned when fewer than two streams have
+	// usable measurements.
+	ErrNotEnoughStreams = errors.New("at least two streams with measurements are required")
+	// ErrNoOverlap is returned when there is no time interval during which
+	// all the streams were running.
+	ErrNoOverlap = errors.New("streams do not overlap in time")
+)
+
+// Stream is the throughput of a single stream over the report's window.
+type Stream struct {
+	UUID              string
+	CongestionControl string
+	// Throughput is the average throughput in Mb/s.
+	Throughput float64
+}
+
+// Report describes how the throughput was shared among streams while they
+// were all running.
+type Report struct {
+	// Start and End delimit the interval during which all the streams were
+	// running. Throughputs are computed over this interval only.
+	Start time.Time
+	End   time.Time
+	// Streams is the throughput of each stream.
+	Streams []Stream
+	// Shares maps each congestion control algorithm to the fraction of the
+	// aggregate throughput obtained by the streams using it.
+	Shares map[string]float64
+	// JainIndex is Jain's fairness index of the per-stream throughputs. It
+	// ranges from 1/n (one stream got everything) to 1 (perfectly fair).
+	JainIndex float64
+}
+
+// sample is a point of a stream's cumulative byte count series.
+type sample struct {
+	t     time.Time
+	bytes float64
+}
+
+// Compute computes a fairness Report for the given per-stream results, using
+// the AppInfo measured by the receiver of each stream.
+func Compute(res []*results.NDTMResult) (*Report, error) {
+	type series struct {
+		result  *results.NDTMResult
+		samples []sample
+	}
+	var all []series
+	for _, r := range res {
+		s := receiverSamples(r)
+		if len(s) < 2 {
+			continue
+		}
+		all = append(all, series{result: r, samples: s})
+	}
+	if len(all) < 2 {
+		return nil, ErrNotEnoughStreams
+	}
+
+	// Find the interval during which all the streams were running.
+	start, end := all[0].samples[0].t, all[0].samples[len(all[0].samples)-1].t
+	for _, s := range all[1:] {
+		if first := s.samples[0].t; first.After(start) {
+			start = first
+		}
+		if last := s.samples[len(s.samples)-1].t; last.Before(end) {
+			end = last
+		}
+	}
+	if !end.After(start) {
+		return nil, ErrNoOverlap
+	}
+
+	report := &Report{
+		Start:  start,
+		End:    end,
+		Shares: map[string]float64{},
+	}
+	var sum, sumSquares float64
+	for _, s := range all {
+		bytes := bytesAt(s.samples, end) - bytesAt(s.samples, start)
+		tput := bytes * 8 / end.Sub(start).Seconds() / 1e6
+		cc := senderCC(s.result)
+		report.Streams = append(report.Streams, Stream{
+			UUID:              s.result.UUID,
+			CongestionControl: cc,
+			Throughput:        tput,
+		})
+		report.Shares[cc] += tput
+		sum += tput
+		sumSquares += tput * tput
+	}
+	if sum > 0 {
+		for cc := range report.Shares {
+			report.Shares[cc] /= sum
+		}
+		report.JainIndex = sum * sum / (float64(len(all)) * sumSquares)
+	}
+	return report, nil
+}
+
+// receiverSamples returns the cumulative byte count series measured by the
+// receiver of the stream, in absolute time on the client's clock.
+func receiverSamples(r *results.NDTMResult) []sample {
+	measurements := r.ClientMeasurements
+	if r.SubTest == string(spec.SubtestUpload) {
+		measurements = r.ServerMeasurements
+	}
+	var received []results.Measurement
+	for _, m := range measurements {
+		if m.Origin == "receiver" && m.AppInfo != nil {
+			received = append(received, m)
+		}
+	}
+	if len(received) == 0 {
+		return nil
+	}
+	at := receiverClock(r, received)
+	// The receiver's byte count starts at zero when the flow starts.
+	first := received[0].AppInfo
+	samples := []sample{{t: at(received[0]).Add(-time.Duration(first.ElapsedTime) * time.Microsecond)}}
+	for _, m := range received {
+		samples = append(samples, sample{
+			t:     at(m),
+			bytes: float64(m.AppInfo.NumBytes),
+		})
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].t.Before(samples[j].t)
+	})
+	return samples
+}
+
+// receiverClock returns a function giving the time at which each of the
+// receiver's measurements was taken, on the client's clock. Timestamps are
+// used if all the measurements have one and, for the server's measurements,
+// the clock offset is known. Otherwise, the time is estimated from StartTime
+// and ElapsedTime.
+func receiverClock(r *results.NDTMResult, received []results.Measurement) func(results.Measurement) time.Time {
+	estimate := func(m results.Measurement) time.Time {
+		return r.StartTime.Add(time.Duration(m.AppInfo.ElapsedTime) * time.Microsecond)
+	}
+	for _, m := range received {
+		if m.Timestamp.IsZero() {
+			return estimate
+		}
+	}
+	if r.SubTest != string(spec.SubtestUpload) {
+		// The client is the receiver.
+		return func(m results.Measurement) time.Time { return m.Timestamp }
+	}
+	if r.ClockSync == nil {
+		return estimate
+	}
+	// ClockSync.Offset is the server's clock minus the client's.
+	offset := time.Duration(r.ClockSync.Offset) * time.Microsecond
+	return func(m results.Measurement) time.Time { return m.Timestamp.Add(-offset) }
+}
+
+// bytesAt returns the byte count at time t, linearly interpolated between the
+// two closest samples.
+func bytesAt(samples []sample, t time.Time) float64 {
+	for i := 1; i < len(samples); i++ {
+		prev, next := samples[i-1], samples[i]
+		if next.t.Before(t) {
+			continue
+		}
+		dt := next.t.Sub(prev.t)
+		if dt <= 0 {
+			return next.bytes
+		}
+		frac := float64(t.Sub(prev.t)) / float64(dt)
+		return prev.bytes + frac*(next.bytes-prev.bytes)
+	}
+	return samples[len(samples)-1].bytes
+}
+
+// senderCC returns the congestion control algorithm of the stream's sender,
+// which is the one determining how it competes with the other streams. Only
+// the peer's algorithm is recorded in its own field: if empty, the sender is
+// the endpoint that wrote the result.
+func senderCC(r *results.NDTMResult) string {
+	cc := r.ServerCongestionControl
+	if r.SubTest == string(spec.SubtestUpload) {
+		cc = r.ClientCongestionControl
+	}
+	if cc == "" {
+		return r.CongestionControl
+	}
+	return cc
+}
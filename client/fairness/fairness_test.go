@@ -0,0 +1,161 @@
+package fairness
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+)
+
+var base = time.Date(2023, 5, 4, 10, 0, 0, 0, time.UTC)
+
+// flow describes a test stream receiving rate bytes/s for length, starting
+// at start on the client's clock.
+type flow struct {
+	subtest spec.SubtestKind
+	cc      string
+	start   time.Duration
+	length  time.Duration
+	rate    float64
+	// timestamps is whether measurements have a Timestamp. For uploads,
+	// they are on the server's clock, which is offset ahead of the
+	// client's.
+	timestamps bool
+	offset     time.Duration
+}
+
+func (f flow) result(uuid string) *results.NDTMResult {
+	r := &results.NDTMResult{
+		UUID:              uuid,
+		SubTest:           string(f.subtest),
+		StartTime:         base.Add(f.start),
+		CongestionControl: f.cc,
+	}
+	if f.subtest == spec.SubtestUpload && f.timestamps {
+		r.ClockSync = &results.ClockSync{Offset: f.offset.Microseconds()}
+		// The handshake delays StartTime, which must not be used to align
+		// timestamped measurements.
+		r.StartTime = r.StartTime.Add(-2 * time.Second)
+	}
+	for e := 100 * time.Millisecond; e <= f.length; e += 100 * time.Millisecond {
+		m := results.Measurement{
+			Origin: "receiver",
+			AppInfo: &results.AppInfo{
+				NumBytes:    int64(f.rate * e.Seconds()),
+				ElapsedTime: e.Microseconds(),
+			},
+		}
+		if f.timestamps {
+			m.Timestamp = base.Add(f.start + e)
+		}
+		if f.subtest == spec.SubtestUpload {
+			if f.timestamps {
+				m.Timestamp = m.Timestamp.Add(f.offset)
+			}
+			r.ServerMeasurements = append(r.ServerMeasurements, m)
+		} else {
+			r.ClientMeasurements = append(r.ClientMeasurements, m)
+		}
+	}
+	return r
+}
+
+func TestCompute(t *testing.T) {
+	tests := []struct {
+		name      string
+		flows     []flow
+		wantStart time.Duration
+		wantEnd   time.Duration
+		wantJain  float64
+		wantShare map[string]float64
+		wantErr   error
+	}{
+		{
+			name: "equal-download",
+			flows: []flow{
+				{subtest: spec.SubtestDownload, cc: "bbr", length: 5 * time.Second, rate: 1e6, timestamps: true},
+				{subtest: spec.SubtestDownload, cc: "cubic", start: time.Second, length: 4 * time.Second, rate: 1e6, timestamps: true},
+			},
+			wantStart: time.Second,
+			wantEnd:   5 * time.Second,
+			wantJain:  1,
+			wantShare: map[string]float64{"bbr": 0.5, "cubic": 0.5},
+		},
+		{
+			name: "unequal-download-without-timestamps",
+			flows: []flow{
+				{subtest: spec.SubtestDownload, cc: "bbr", length: 5 * time.Second, rate: 3e6},
+				{subtest: spec.SubtestDownload, cc: "cubic", length: 5 * time.Second, rate: 1e6},
+			},
+			wantStart: 0,
+			wantEnd:   5 * time.Second,
+			// (3+1)^2 / (2 * (3^2+1^2))
+			wantJain:  0.8,
+			wantShare: map[string]float64{"bbr": 0.75, "cubic": 0.25},
+		},
+		{
+			name: "unequal-upload-with-clock-offset",
+			flows: []flow{
+				{subtest: spec.SubtestUpload, cc: "bbr", length: 5 * time.Second, rate: 1e6,
+					timestamps: true, offset: time.Hour},
+				{subtest: spec.SubtestUpload, cc: "bbr", start: 2 * time.Second, length: 3 * time.Second, rate: 1e6 / 3,
+					timestamps: true, offset: time.Hour},
+			},
+			wantStart: 2 * time.Second,
+			wantEnd:   5 * time.Second,
+			wantJain:  0.8,
+			wantShare: map[string]float64{"bbr": 1},
+		},
+		{
+			name: "one-stream",
+			flows: []flow{
+				{subtest: spec.SubtestDownload, cc: "bbr", length: 5 * time.Second, rate: 1e6},
+			},
+			wantErr: ErrNotEnoughStreams,
+		},
+		{
+			name: "no-overlap",
+			flows: []flow{
+				{subtest: spec.SubtestDownload, cc: "bbr", length: 2 * time.Second, rate: 1e6, timestamps: true},
+				{subtest: spec.SubtestDownload, cc: "bbr", start: 3 * time.Second, length: 2 * time.Second, rate: 1e6, timestamps: true},
+			},
+			wantErr: ErrNoOverlap,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res []*results.NDTMResult
+			for i, f := range tt.flows {
+				res = append(res, f.result(string(rune('a'+i))))
+			}
+			report, err := Compute(res)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Compute() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !report.Start.Equal(base.Add(tt.wantStart)) || !report.End.Equal(base.Add(tt.wantEnd)) {
+				t.Errorf("Compute() window = [%v, %v], want [%v, %v]", report.Start, report.End,
+					base.Add(tt.wantStart), base.Add(tt.wantEnd))
+			}
+			if math.Abs(report.JainIndex-tt.wantJain) > 1e-3 {
+				t.Errorf("Compute() JainIndex = %f, want %f", report.JainIndex, tt.wantJain)
+			}
+			for cc, want := range tt.wantShare {
+				if got := report.Shares[cc]; math.Abs(got-want) > 1e-3 {
+					t.Errorf("Compute() Shares[%s] = %f, want %f", cc, got, want)
+				}
+			}
+			for i, s := range report.Streams {
+				want := tt.flows[i].rate * 8 / 1e6
+				if math.Abs(s.Throughput-want) > want*1e-3 {
+					t.Errorf("Compute() Streams[%d].Throughput = %f, want %f", i, s.Throughput, want)
+				}
+			}
+		})
+	}
+}
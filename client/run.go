@@ -0,0 +1,146 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/robertodauria/msak/client/emitter"
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+)
+
+// Run is the outcome of a Download or Upload measurement.
+type Run struct {
+	// MeasurementID identifies the streams belonging to this measurement.
+	MeasurementID string
+	// SubTest is the kind of measurement.
+	SubTest spec.SubtestKind
+	// StartTime and EndTime delimit the whole measurement.
+	StartTime time.Time
+	EndTime   time.Time
+	// Streams contains the result of each stream, in schedule order. It is
+	// nil for streams that failed before the measurement started.
+	Streams []*results.NDTMResult
+	// Errors contains the error of each stream, in schedule order. It is nil
+	// for streams that completed without errors.
+	Errors []error
+	// Summary contains the throughput measured by the receiver.
+	Summary Summary
+}
+
+// Summary summarizes the throughput of a Run, as measured by the receiver.
+type Summary struct {
+	// Streams is the number of streams that started the measurement.
+	Streams int
+	// NumBytes is the total number of bytes received.
+	NumBytes int64
+	// Elapsed is the time between the start of the first stream and the
+	// end of the last one.
+	Elapsed time.Duration
+	// Throughput is the aggregate throughput in Mb/s.
+	Throughput float64
+	// StreamsThroughput is the average throughput of each stream in Mb/s,
+	// in schedule order. It is zero for streams without measurements.
+	StreamsThroughput []float64
+	// Middleboxes is the number of streams where a buffering or proxying
+	// middlebox is likely, according to their ByteDivergence.
+	Middleboxes int
+}
+
+// summarize computes the Summary of the given per-stream results.
+func summarize(streams []*results.NDTMResult) Summary {
+	s := Summary{
+		StreamsThroughput: make([]float64, len(streams)),
+	}
+	var start, end time.Time
+	for i, r := range streams {
+		if r == nil {
+			continue
+		}
+		s.Streams++
+		if d := r.ByteDivergence; d != nil && (d.Buffering || d.Proxying) {
+			s.Middleboxes++
+		}
+		if start.IsZero() || r.StartTime.Before(start) {
+			start = r.StartTime
+		}
+		if r.EndTime.After(end) {
+			end = r.EndTime
+		}
+		last := lastReceiverAppInfo(r)
+		if last == nil || last.ElapsedTime == 0 {
+			continue
+		}
+		s.NumBytes += last.NumBytes
+		s.StreamsThroughput[i] = float64(last.NumBytes) * 8 / float64(last.ElapsedTime)
+	}
+	if end.After(start) {
+		s.Elapsed = end.Sub(start)
+		s.Throughput = float64(s.NumBytes) * 8 / float64(s.Elapsed.Microseconds())
+	}
+	return s
+}
+
+// lastReceiverAppInfo returns the last AppInfo measured by the receiver of
+// the stream, if any.
+func lastReceiverAppInfo(r *results.NDTMResult) *results.AppInfo {
+	measurements := r.ClientMeasurements
+	if r.SubTest == string(spec.SubtestUpload) {
+		measurements = r.ServerMeasurements
+	}
+	var last *results.AppInfo
+	for _, m := range measurements {
+		if m.Origin == "receiver" && m.AppInfo != nil {
+			last = m.AppInfo
+		}
+	}
+	return last
+}
+
+// progress tracks the aggregate progress of a run across its streams.
+type progress struct {
+	mu        sync.Mutex
+	startTime time.Time
+	active    int
+	numBytes  []int64
+}
+
+func newProgress(start time.Time, streams int) *progress {
+	return &progress{
+		startTime: start,
+		numBytes:  make([]int64, streams),
+	}
+}
+
+// start records that a stream has started.
+func (p *progress) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active++
+}
+
+// complete records that a stream has completed.
+func (p *progress) complete() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active--
+}
+
+// update records the number of bytes received so far by the i-th stream and
+// returns the updated aggregate progress.
+func (p *progress) update(i int, numBytes int64) emitter.Progress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.numBytes[i] = numBytes
+	prog := emitter.Progress{
+		Elapsed:       time.Since(p.startTime),
+		ActiveStreams: p.active,
+	}
+	for _, n := range p.numBytes {
+		prog.NumBytes += n
+	}
+	if prog.Elapsed > 0 {
+		prog.Throughput = float64(prog.NumBytes) * 8 / float64(prog.Elapsed.Microseconds())
+	}
+	return prog
+}
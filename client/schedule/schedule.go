@@ -0,0 +1,291 @@
+// Package schedule describes when each stream of a multi-stream measurement
+// starts and how long it lasts.
+package schedule
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+)
+
+// MaxStreams is the maximum number of streams in a schedule.
+const MaxStreams = 128
+
+var (
+	// ErrEmpty is returned when a schedule has no streams.
+	ErrEmpty = errors.New("schedule has no streams")
+	// ErrTooManyStreams is returned when a schedule has more than
+	// MaxStreams streams.
+	ErrTooManyStreams = fmt.Errorf("schedule has more than %d streams", MaxStreams)
+)
+
+// Stream describes a single stream of a measurement.
+type Stream struct {
+	// Start is the stream's start offset from the beginning of the
+	// measurement.
+	Start time.Duration
+	// Duration is how long the stream lasts.
+	Duration time.Duration
+}
+
+// End returns the stream's end offset from the beginning of the measurement.
+func (s Stream) End() time.Duration {
+	return s.Start + s.Duration
+}
+
+// String returns the stream in the compact start+duration form accepted by
+// Parse.
+func (s Stream) String() string {
+	return s.Start.String() + "+" + s.Duration.String()
+}
+
+// Schedule is the list of streams of a measurement. Stream i of the schedule
+// is stream i of the measurement.
+type Schedule []Stream
+
+// Simultaneous returns a schedule of n streams starting together and lasting
+// duration.
+func Simultaneous(n int, duration time.Duration) Schedule {
+	return Staggered(n, 0, duration)
+}
+
+// Staggered returns a schedule of n streams starting delay apart from each
+// other, each lasting duration. The schedule is empty if n is not positive.
+func Staggered(n int, delay, duration time.Duration) Schedule {
+	if n <= 0 {
+		return Schedule{}
+	}
+	s := make(Schedule, n)
+	for i := range s {
+		s[i] = Stream{
+			Start:    time.Duration(i) * delay,
+			Duration: duration,
+		}
+	}
+	return s
+}
+
+// Ramp returns a schedule of n streams starting delay apart from each other
+// and all ending length after the beginning of the measurement, so that the
+// number of concurrent streams ramps up over time. The schedule is empty if n
+// is not positive.
+func Ramp(n int, delay, length time.Duration) Schedule {
+	if n <= 0 {
+		return Schedule{}
+	}
+	s := make(Schedule, n)
+	for i := range s {
+		start := time.Duration(i) * delay
+		s[i] = Stream{
+			Start:    start,
+			Duration: length - start,
+		}
+	}
+	return s
+}
+
+// Validate checks that the schedule has at least one stream and at most
+// MaxStreams, that no stream starts before the beginning of the measurement
+// and that each stream's duration is positive and not longer than
+// spec.MaxRuntime.
+func (s Schedule) Validate() error {
+	if len(s) == 0 {
+		return ErrEmpty
+	}
+	if len(s) > MaxStreams {
+		return ErrTooManyStreams
+	}
+	for i, st := range s {
+		if st.Start < 0 {
+			return fmt.Errorf("stream #%d: negative start offset %v", i, st.Start)
+		}
+		if st.Duration <= 0 {
+			return fmt.Errorf("stream #%d: non-positive duration %v", i, st.Duration)
+		}
+		if st.Duration > spec.MaxRuntime {
+			return fmt.Errorf("stream #%d: duration %v exceeds the maximum runtime (%v)",
+				i, st.Duration, spec.MaxRuntime)
+		}
+	}
+	return nil
+}
+
+// Length returns the time between the beginning of the measurement and the
+// end of its last stream.
+func (s Schedule) Length() time.Duration {
+	var length time.Duration
+	for _, st := range s {
+		if st.End() > length {
+			length = st.End()
+		}
+	}
+	return length
+}
+
+// String returns the schedule in the compact form accepted by Parse.
+func (s Schedule) String() string {
+	entries := make([]string, len(s))
+	for i, st := range s {
+		entries[i] = st.String()
+	}
+	return strings.Join(entries, ",")
+}
+
+// Parse parses a schedule from its compact string form, which is either a
+// pattern:
+//
+//	simultaneous:<n>:<duration>
+//	staggered:<n>:<delay>:<duration>
+//	ramp:<n>:<delay>:<length>
+//
+// or a comma-separated list of <start>+<duration> entries, each optionally
+// followed by x<count> to repeat it, e.g. "0s+10s,2s+5sx3". The returned
+// schedule is validated.
+func Parse(str string) (Schedule, error) {
+	s, err := parse(str)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Load reads a schedule from a file. Each line contains a pattern or a list
+// of entries in the form accepted by Parse, and the resulting streams are
+// concatenated. Empty lines and lines starting with # are ignored. The
+// returned schedule is validated.
+func Load(path string) (Schedule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var s Schedule
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		streams, err := parse(line)
+		if err == nil && len(s)+len(streams) > MaxStreams {
+			err = ErrTooManyStreams
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		s = append(s, streams...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func parse(str string) (Schedule, error) {
+	fields := strings.Split(strings.TrimSpace(str), ":")
+	switch fields[0] {
+	case "simultaneous":
+		n, d, err := parsePattern(fields, 1)
+		if err != nil {
+			return nil, err
+		}
+		return Simultaneous(n, d[0]), nil
+	case "staggered":
+		n, d, err := parsePattern(fields, 2)
+		if err != nil {
+			return nil, err
+		}
+		return Staggered(n, d[0], d[1]), nil
+	case "ramp":
+		n, d, err := parsePattern(fields, 2)
+		if err != nil {
+			return nil, err
+		}
+		return Ramp(n, d[0], d[1]), nil
+	}
+	if len(fields) != 1 {
+		return nil, fmt.Errorf("unknown schedule pattern %q", fields[0])
+	}
+	var s Schedule
+	for _, entry := range strings.Split(str, ",") {
+		streams, err := parseEntry(strings.TrimSpace(entry))
+		if err != nil {
+			return nil, err
+		}
+		if len(s)+len(streams) > MaxStreams {
+			return nil, ErrTooManyStreams
+		}
+		s = append(s, streams...)
+	}
+	return s, nil
+}
+
+// parsePattern parses the number of streams and the given number of
+// durations from the fields of a pattern.
+func parsePattern(fields []string, durations int) (int, []time.Duration, error) {
+	if len(fields) != durations+2 {
+		return 0, nil, fmt.Errorf("pattern %q requires %d arguments", fields[0], durations+1)
+	}
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n <= 0 {
+		return 0, nil, fmt.Errorf("invalid number of streams %q", fields[1])
+	}
+	if n > MaxStreams {
+		return 0, nil, ErrTooManyStreams
+	}
+	d := make([]time.Duration, durations)
+	for i := range d {
+		d[i], err = time.ParseDuration(fields[i+2])
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return n, d, nil
+}
+
+// parseEntry parses a <start>+<duration>[x<count>] entry.
+func parseEntry(entry string) (Schedule, error) {
+	count := 1
+	// Duration units never contain an "x", so the last one (if any)
+	// introduces the repeat count.
+	if i := strings.LastIndex(entry, "x"); i >= 0 {
+		var err error
+		count, err = strconv.Atoi(entry[i+1:])
+		if err != nil || count <= 0 {
+			return nil, fmt.Errorf("invalid repeat count in %q", entry)
+		}
+		if count > MaxStreams {
+			return nil, ErrTooManyStreams
+		}
+		entry = entry[:i]
+	}
+	start, duration, found := strings.Cut(entry, "+")
+	if !found {
+		return nil, fmt.Errorf("invalid schedule entry %q: expected <start>+<duration>", entry)
+	}
+	st := Stream{}
+	var err error
+	if st.Start, err = time.ParseDuration(start); err != nil {
+		return nil, err
+	}
+	if st.Duration, err = time.ParseDuration(duration); err != nil {
+		return nil, err
+	}
+	s := make(Schedule, count)
+	for i := range s {
+		s[i] = st
+	}
+	return s, nil
+}
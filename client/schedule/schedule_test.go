@@ -0,0 +1,275 @@
+package schedule
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		str     string
+		want    Schedule
+		wantErr error
+	}{
+		{
+			name: "simultaneous",
+			str:  "simultaneous:3:10s",
+			want: Schedule{{0, 10 * time.Second}, {0, 10 * time.Second}, {0, 10 * time.Second}},
+		},
+		{
+			name: "staggered",
+			str:  "staggered:3:2s:5s",
+			want: Schedule{{0, 5 * time.Second}, {2 * time.Second, 5 * time.Second}, {4 * time.Second, 5 * time.Second}},
+		},
+		{
+			name: "ramp",
+			str:  "ramp:3:2s:10s",
+			want: Schedule{{0, 10 * time.Second}, {2 * time.Second, 8 * time.Second}, {4 * time.Second, 6 * time.Second}},
+		},
+		{
+			name: "entries",
+			str:  " 0s+10s, 1.5s+5s ",
+			want: Schedule{{0, 10 * time.Second}, {1500 * time.Millisecond, 5 * time.Second}},
+		},
+		{
+			name: "repeat",
+			str:  "0s+10s,2s+5sx3",
+			want: Schedule{{0, 10 * time.Second}, {2 * time.Second, 5 * time.Second},
+				{2 * time.Second, 5 * time.Second}, {2 * time.Second, 5 * time.Second}},
+		},
+		{
+			name: "repeat-minutes",
+			str:  "0s+0.1mx2",
+			want: Schedule{{0, 6 * time.Second}, {0, 6 * time.Second}},
+		},
+		{
+			name:    "repeat-without-count",
+			str:     "0s+1mx",
+			wantErr: errAny,
+		},
+		{
+			name:    "repeat-zero",
+			str:     "0s+1sx0",
+			wantErr: errAny,
+		},
+		{
+			name:    "repeat-negative",
+			str:     "0s+1sx-1",
+			wantErr: errAny,
+		},
+		{
+			name:    "missing-duration",
+			str:     "0s",
+			wantErr: errAny,
+		},
+		{
+			name:    "empty",
+			str:     "",
+			wantErr: errAny,
+		},
+		{
+			name:    "invalid-duration",
+			str:     "0s+10",
+			wantErr: errAny,
+		},
+		{
+			name:    "unknown-pattern",
+			str:     "linear:3:1s",
+			wantErr: errAny,
+		},
+		{
+			name:    "pattern-arguments",
+			str:     "staggered:3:1s",
+			wantErr: errAny,
+		},
+		{
+			name:    "pattern-no-streams",
+			str:     "simultaneous:0:10s",
+			wantErr: errAny,
+		},
+		{
+			name:    "pattern-negative-streams",
+			str:     "ramp:-1:1s:10s",
+			wantErr: errAny,
+		},
+		{
+			name: "pattern-max-streams",
+			str:  "simultaneous:128:10s",
+			want: Simultaneous(MaxStreams, 10*time.Second),
+		},
+		{
+			name:    "pattern-too-many-streams",
+			str:     "simultaneous:129:10s",
+			wantErr: ErrTooManyStreams,
+		},
+		{
+			name:    "repeat-too-many-streams",
+			str:     "0s+10sx129",
+			wantErr: ErrTooManyStreams,
+		},
+		{
+			name:    "entries-too-many-streams",
+			str:     "0s+10sx100,1s+5sx29",
+			wantErr: ErrTooManyStreams,
+		},
+		{
+			name:    "ramp-ends-before-last-start",
+			str:     "ramp:3:5s:10s",
+			wantErr: errAny,
+		},
+		{
+			name:    "exceeds-max-runtime",
+			str:     "0s+" + (spec.MaxRuntime + time.Second).String(),
+			wantErr: errAny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.str)
+			checkErr(t, "Parse()", err, tt.wantErr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseString(t *testing.T) {
+	s := Schedule{{0, 10 * time.Second}, {1500 * time.Millisecond, 5 * time.Second}}
+	got, err := Parse(s.String())
+	if err != nil {
+		t.Fatalf("Parse(%q) error = %v", s.String(), err)
+	}
+	if !reflect.DeepEqual(got, s) {
+		t.Errorf("Parse(%q) = %v, want %v", s.String(), got, s)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    Schedule
+		wantErr error
+	}{
+		{
+			name:    "lines",
+			content: "# Two bulk flows.\nsimultaneous:2:10s\n\n  # A late one.\n5s+5s\n",
+			want:    Schedule{{0, 10 * time.Second}, {0, 10 * time.Second}, {5 * time.Second, 5 * time.Second}},
+		},
+		{
+			name:    "empty",
+			content: "# Nothing.\n",
+			wantErr: ErrEmpty,
+		},
+		{
+			name:    "invalid-line",
+			content: "0s+10s\nstaggered:2\n",
+			wantErr: errAny,
+		},
+		{
+			name:    "too-many-streams",
+			content: "simultaneous:100:10s\nsimultaneous:29:10s\n",
+			wantErr: ErrTooManyStreams,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "schedule.txt")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Load(path)
+			checkErr(t, "Load()", err, tt.wantErr)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Load() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Load(missing) error = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       Schedule
+		wantErr error
+	}{
+		{
+			name: "valid",
+			s:    Schedule{{0, spec.MaxRuntime}, {time.Minute, time.Second}},
+		},
+		{
+			name:    "nil",
+			wantErr: ErrEmpty,
+		},
+		{
+			name:    "max-streams",
+			s:       Simultaneous(MaxStreams, time.Second),
+			wantErr: nil,
+		},
+		{
+			name:    "too-many-streams",
+			s:       Simultaneous(MaxStreams+1, time.Second),
+			wantErr: ErrTooManyStreams,
+		},
+		{
+			name:    "negative-start",
+			s:       Schedule{{-time.Second, time.Second}},
+			wantErr: errAny,
+		},
+		{
+			name:    "zero-duration",
+			s:       Schedule{{0, time.Second}, {time.Second, 0}},
+			wantErr: errAny,
+		},
+		{
+			name:    "exceeds-max-runtime",
+			s:       Schedule{{0, spec.MaxRuntime + 1}},
+			wantErr: errAny,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkErr(t, "Validate()", tt.s.Validate(), tt.wantErr)
+		})
+	}
+}
+
+func TestPatternsNonPositive(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		if s := Staggered(n, time.Second, time.Second); len(s) != 0 {
+			t.Errorf("Staggered(%d) = %v, want an empty schedule", n, s)
+		}
+		if s := Ramp(n, time.Second, 10*time.Second); len(s) != 0 {
+			t.Errorf("Ramp(%d) = %v, want an empty schedule", n, s)
+		}
+		if err := Ramp(n, time.Second, 10*time.Second).Validate(); !errors.Is(err, ErrEmpty) {
+			t.Errorf("Ramp(%d).Validate() error = %v, want %v", n, err, ErrEmpty)
+		}
+	}
+}
+
+// errAny matches any non-nil error in checkErr.
+var errAny = errors.New("any error")
+
+func checkErr(t *testing.T, name string, err, want error) {
+	t.Helper()
+	switch {
+	case want == nil && err != nil:
+		t.Fatalf("%s error = %v, want nil", name, err)
+	case want == errAny && err == nil:
+		t.Fatalf("%s error = nil, want an error", name)
+	case want != nil && want != errAny && !errors.Is(err, want):
+		t.Fatalf("%s error = %v, want %v", name, err, want)
+	}
+}
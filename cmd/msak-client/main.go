@@ -3,51 +3,347 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/m-lab/go/rtx"
 	"github.com/robertodauria/msak/client"
+	"github.com/robertodauria/msak/client/config"
+	"github.com/robertodauria/msak/client/fairness"
+	"github.com/robertodauria/msak/client/schedule"
+	"github.com/robertodauria/msak/pkg/ndtm"
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
 	"go.uber.org/zap"
 )
 
 var (
-	flagServer   = flag.String("server", "", "Server address")
-	flagStreams  = flag.Int("streams", 2, "Number of streams")
-	flagCC       = flag.String("cc", "bbr", "Congestion control algorithm to use")
-	flagDelay    = flag.Duration("delay", 5*time.Second, "Delay between each stream")
-	flagDuration = flag.Duration("duration", 10*time.Second, "Length of the last stream")
-	flagScheme   = flag.String("scheme", "ws", "Websocket scheme (wss or ws)")
-	flagOutput   = flag.String("output", "", "Path to write measurement results to")
+	flagServer       = flag.String("server", "", "Server address")
+	flagTest         = flag.String("test", "download", "Subtests to run in order, comma-separated (download, upload or both)")
+	flagStreams      = flag.Int("streams", 2, "Number of streams")
+	flagCC           = flag.String("cc", "bbr", "Congestion control algorithm to use (comma-separated list to use one per stream, e.g. bbr,cubic,cubic)")
+	flagDelay        = flag.Duration("delay", 5*time.Second, "Delay between each stream")
+	flagDuration     = flag.Duration("duration", 10*time.Second, "Length of the measurement (all streams end after this time)")
+	flagSchedule     = flag.String("schedule", "", "Per-stream schedule overriding -streams, -delay and -duration (e.g. 0s+10s,2s+8sx2 or staggered:3:2s:10s)")
+	flagScheduleFile = flag.String("schedule.file", "", "File to read the per-stream schedule from")
+	flagScheme       = flag.String("scheme", "ws", "Websocket scheme (wss or ws)")
+	flagOutput       = flag.String("output", "", "Path to write measurement results to")
+	flagOutputFormat = flag.String("output.format", "json", "Format to write measurement results in: json or compact")
+	flagClockSync    = flag.Int("clocksync", spec.DefaultClockSyncSamples, "Number of exchanges to estimate the clock offset from the server with (0 to disable)")
+	flagBuffer       = flag.Int("measurements.buffer", ndtm.DefaultDeliveryPolicy.BufferSize, "Number of measurements buffered for each stream")
+	flagDelivery     = flag.String("measurements.delivery", string(ndtm.DefaultDeliveryPolicy.Mode), "What to do with measurements when the buffer is full: drop or block")
+	flagEncoding     = flag.String("encoding", string(ndtm.EncodingJSON), "Encoding to request for measurement messages: json or cbor")
+	flagNoVerify     = flag.Bool("tls.no-verify", false, "Skip verification of the server's TLS certificate")
+	flagCAFile       = flag.String("tls.ca", "", "PEM file with the CAs to verify the server's TLS certificate with")
+	flagServerName   = flag.String("tls.server-name", "", "Server name to use for SNI and certificate verification (default: the server's host)")
+	flagTLSMin       = flag.String("tls.min-version", "", "Minimum TLS version to accept (1.0, 1.1, 1.2 or 1.3)")
+	flagCertFile     = flag.String("tls.cert", "", "PEM file with the client certificate to present to the server")
+	flagKeyFile      = flag.String("tls.key", "", "PEM file with the client certificate's key")
+	flagConfig       = flag.String("config", "", "YAML or JSON file to read the client configuration profiles from (flags set explicitly take precedence)")
+	flagProfile      = flag.String("profile", config.DefaultProfile, "Name of the profile to use from the -config file")
+
+	// subtestFlags contains the per-subtest settings overriding the global
+	// ones, registered as -<subtest>.<flag>.
+	subtestFlags = map[spec.SubtestKind]*subtestConfig{
+		spec.SubtestDownload: {},
+		spec.SubtestUpload:   {},
+	}
 )
 
+// subtestConfig contains the settings that can be overridden per subtest.
+// Zero values mean the global setting applies.
+type subtestConfig struct {
+	streams      int
+	duration     time.Duration
+	schedule     string
+	scheduleFile string
+}
+
+func init() {
+	for kind, cfg := range subtestFlags {
+		k := string(kind)
+		flag.IntVar(&cfg.streams, k+".streams", 0, "Number of streams for the "+k+" subtest (overrides -streams)")
+		flag.DurationVar(&cfg.duration, k+".duration", 0, "Length of the "+k+" subtest (overrides -duration)")
+		flag.StringVar(&cfg.schedule, k+".schedule", "", "Per-stream schedule for the "+k+" subtest (overrides -schedule)")
+		flag.StringVar(&cfg.scheduleFile, k+".schedule.file", "", "File to read the "+k+" subtest's schedule from (overrides -schedule.file)")
+	}
+}
+
 func main() {
 	flag.Parse()
 	logger, err := zap.NewDevelopment()
 	rtx.Must(err, "cannot initialize logger")
 	zap.ReplaceGlobals(logger)
 
-	if float64(*flagStreams-1)*flagDelay.Seconds() >= flagDuration.Seconds() {
-		zap.L().Sugar().Error("Invalid configuration: please check streams, delay and duration and make sure they make sense.")
+	subtests, err := parseSubtests(*flagTest)
+	if err != nil {
+		zap.L().Sugar().Errorf("Invalid -test: %v", err)
 		os.Exit(1)
 	}
 
-	cl := client.New("msak-client", "")
-	cl.Server = *flagServer
-	cl.CongestionControl = *flagCC
-	cl.NumStreams = *flagStreams
-	cl.Scheme = *flagScheme
-	cl.MeasurementID = uuid.NewString()
-	cl.Length = *flagDuration
-	cl.Delay = *flagDelay
+	cfg, err := loadConfig()
+	if err != nil {
+		zap.L().Sugar().Errorf("Invalid configuration: %v", err)
+		os.Exit(1)
+	}
 
-	cl.OutputPath = *flagOutput
+	// Validate all the schedules before running anything.
+	schedules := map[spec.SubtestKind]schedule.Schedule{}
+	for _, kind := range subtests {
+		sched, err := getSchedule(kind, cfg)
+		if err != nil {
+			zap.L().Sugar().Errorf("Invalid %s schedule: %v", kind, err)
+			os.Exit(1)
+		}
+		schedules[kind] = sched
+	}
 
-	cl.Download(context.Background())
+	cl, err := client.NewWithConfig("msak-client", "", cfg)
 	if err != nil {
-		zap.L().Error(err.Error())
+		zap.L().Sugar().Errorf("Cannot create client: %v", err)
+		os.Exit(1)
+	}
+	cl.MeasurementID = uuid.NewString()
+
+	failed := false
+	for _, kind := range subtests {
+		cl.Schedule = schedules[kind]
+		var run *client.Run
+		switch kind {
+		case spec.SubtestDownload:
+			run, err = cl.Download(context.Background())
+		case spec.SubtestUpload:
+			run, err = cl.Upload(context.Background())
+		}
+		if err != nil {
+			zap.L().Sugar().Errorf("%s failed: %v", kind, err)
+			failed = true
+			continue
+		}
+
+		printSummary(run)
+		if run.Summary.Streams > 1 {
+			printFairness(run.Streams)
+		}
+		// Some streams can fail without failing the whole run.
+		if n := failedStreams(run); n > 0 {
+			zap.L().Sugar().Errorf("%s: %d of %d streams failed", kind, n, len(run.Errors))
+			failed = true
+		}
+	}
+
+	if failed {
 		os.Exit(1)
 	}
+}
+
+// failedStreams returns the number of streams of run that failed.
+func failedStreams(run *client.Run) int {
+	n := 0
+	for _, err := range run.Errors {
+		if err != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// parseSubtests parses the comma-separated list of subtests to run.
+func parseSubtests(s string) ([]spec.SubtestKind, error) {
+	var subtests []spec.SubtestKind
+	for _, t := range strings.Split(s, ",") {
+		switch t = strings.TrimSpace(t); t {
+		case string(spec.SubtestDownload), string(spec.SubtestUpload):
+			subtests = append(subtests, spec.SubtestKind(t))
+		case "both":
+			subtests = append(subtests, spec.SubtestDownload, spec.SubtestUpload)
+		default:
+			return nil, fmt.Errorf("unknown subtest %q", t)
+		}
+	}
+	return subtests, nil
+}
+
+// loadConfig returns the client configuration. If -config is set, the
+// selected profile is read from it and only the flags set explicitly on the
+// command line override its settings. Otherwise, all the flags are used.
+func loadConfig() (*config.ClientConfig, error) {
+	cfg := config.NewDefault()
+	if *flagConfig != "" {
+		var err error
+		cfg, err = config.Load(*flagConfig, *flagProfile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	apply := func(name string) bool {
+		return *flagConfig == "" || set[name]
+	}
 
+	if apply("server") {
+		cfg.Server = *flagServer
+	}
+	if apply("scheme") {
+		cfg.Scheme = config.DialerScheme(*flagScheme)
+	}
+	if apply("streams") {
+		cfg.Streams = *flagStreams
+	}
+	if apply("duration") {
+		cfg.Duration = *flagDuration
+	}
+	if apply("delay") {
+		cfg.StreamsDelay = *flagDelay
+	}
+	if apply("schedule") {
+		cfg.Schedule = *flagSchedule
+	}
+	if apply("schedule.file") {
+		cfg.ScheduleFile = *flagScheduleFile
+	}
+	if apply("cc") {
+		cfg.CongestionControl = *flagCC
+	}
+	if apply("output") {
+		cfg.OutputPath = *flagOutput
+	}
+	if apply("output.format") {
+		cfg.OutputFormat = *flagOutputFormat
+	}
+	if apply("clocksync") {
+		cfg.ClockSyncSamples = *flagClockSync
+	}
+	if apply("measurements.buffer") {
+		cfg.MeasurementBuffer = *flagBuffer
+	}
+	if apply("measurements.delivery") {
+		cfg.Delivery = *flagDelivery
+	}
+	if apply("encoding") {
+		cfg.Encoding = *flagEncoding
+	}
+	if apply("tls.no-verify") {
+		cfg.NoVerify = *flagNoVerify
+	}
+	if apply("tls.ca") {
+		cfg.CAFile = *flagCAFile
+	}
+	if apply("tls.server-name") {
+		cfg.ServerName = *flagServerName
+	}
+	if apply("tls.min-version") {
+		cfg.TLSMinVersion = *flagTLSMin
+	}
+	if apply("tls.cert") {
+		cfg.CertFile = *flagCertFile
+	}
+	if apply("tls.key") {
+		cfg.KeyFile = *flagKeyFile
+	}
+	return cfg, cfg.Validate()
+}
+
+// getSchedule returns the schedule for the given subtest. Schedules and
+// settings specific to the subtest take precedence over the global ones, and
+// an explicit schedule takes precedence over streams, delay and duration.
+func getSchedule(kind spec.SubtestKind, cfg *config.ClientConfig) (schedule.Schedule, error) {
+	st := subtestFlags[kind]
+	switch {
+	case st.schedule != "":
+		return schedule.Parse(st.schedule)
+	case st.scheduleFile != "":
+		return schedule.Load(st.scheduleFile)
+	case st.streams == 0 && st.duration == 0 && cfg.Schedule != "":
+		return schedule.Parse(cfg.Schedule)
+	case st.streams == 0 && st.duration == 0 && cfg.ScheduleFile != "":
+		return schedule.Load(cfg.ScheduleFile)
+	}
+	streams, duration := cfg.Streams, cfg.Duration
+	if st.streams != 0 {
+		streams = st.streams
+	}
+	if st.duration != 0 {
+		duration = st.duration
+	}
+	s := schedule.Ramp(streams, cfg.StreamsDelay, duration)
+	return s, s.Validate()
+}
+
+// printSummary prints the throughput of each stream, measured by the
+// receiver, and the aggregate throughput of the run.
+func printSummary(run *client.Run) {
+	fmt.Printf("%s summary (%d streams):\n", run.SubTest, len(run.Streams))
+	for i, r := range run.Streams {
+		switch {
+		case r == nil:
+			fmt.Printf("  #%d: failed: %v\n", i, run.Errors[i])
+		case run.Summary.StreamsThroughput[i] == 0:
+			fmt.Printf("  #%d %s: no measurements\n", i, r.UUID)
+		default:
+			fmt.Printf("  #%d %s: %.2f Mb/s%s\n", i, r.UUID, run.Summary.StreamsThroughput[i],
+				middleboxNote(r.ByteDivergence))
+		}
+	}
+	if run.Summary.Elapsed > 0 {
+		fmt.Printf("  aggregate: %.2f Mb/s over %v\n", run.Summary.Throughput,
+			run.Summary.Elapsed.Round(time.Millisecond))
+	}
+	if run.Summary.Middleboxes > 0 {
+		fmt.Printf("  %d of %d streams likely went through a middlebox\n",
+			run.Summary.Middleboxes, run.Summary.Streams)
+	}
+}
+
+// middleboxNote returns a note for the summary line of a stream where a
+// middlebox is likely, or an empty string.
+func middleboxNote(d *results.ByteDivergence) string {
+	switch {
+	case d == nil:
+		return ""
+	case d.Proxying:
+		return fmt.Sprintf(" (proxy likely: acked bytes ahead of the receiver by %.0f%%)",
+			d.AckedLead*100)
+	case d.Buffering:
+		return fmt.Sprintf(" (buffering likely: sent bytes ahead of the receiver by %.0f%%)",
+			d.SentLead*100)
+	}
+	return ""
+}
+
+// printFairness prints a report of how the throughput was shared among the
+// streams and their congestion control algorithms.
+func printFairness(streams []*results.NDTMResult) {
+	var res []*results.NDTMResult
+	for _, r := range streams {
+		if r != nil {
+			res = append(res, r)
+		}
+	}
+	report, err := fairness.Compute(res)
+	if err != nil {
+		fmt.Printf("Cannot compute fairness report: %v\n", err)
+		return
+	}
+	fmt.Printf("Fairness over %v (all streams running):\n",
+		report.End.Sub(report.Start).Round(time.Millisecond))
+	for _, s := range report.Streams {
+		fmt.Printf("  %s (%s): %.2f Mb/s\n", s.UUID, s.CongestionControl, s.Throughput)
+	}
+	ccs := make([]string, 0, len(report.Shares))
+	for cc := range report.Shares {
+		ccs = append(ccs, cc)
+	}
+	sort.Strings(ccs)
+	for _, cc := range ccs {
+		fmt.Printf("  %s share: %.1f%%\n", cc, report.Shares[cc]*100)
+	}
+	fmt.Printf("  Jain's fairness index: %.3f\n", report.JainIndex)
 }
@@ -0,0 +1,68 @@
+// msak-convert converts archived results between the JSON and the compact
+// format. Files whose name ends with .gz are read and written gzipped.
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/robertodauria/msak/internal/persistence"
+	"github.com/robertodauria/msak/pkg/ndtm/archive"
+)
+
+var (
+	flagTo = flag.String("to", string(persistence.FormatCompact), "Format to convert to: json or compact")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-to json|compact] <input> <output>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	format, err := persistence.ParseFormat(*flagTo)
+	rtx.Must(err, "Invalid -to")
+
+	// ReadFile accepts both formats, so that files can be converted to the
+	// format they are in already.
+	result, err := archive.ReadFile(flag.Arg(0))
+	rtx.Must(err, "Cannot read %s", flag.Arg(0))
+
+	var out interface{} = result
+	if format == persistence.FormatCompact {
+		out, err = persistence.ToCompact(result)
+		rtx.Must(err, "Cannot convert to the compact format")
+	}
+	data, err := json.Marshal(out)
+	rtx.Must(err, "Cannot encode the result")
+	rtx.Must(writeFile(flag.Arg(1), data), "Cannot write %s", flag.Arg(1))
+}
+
+func writeFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(path, ".gz") {
+		gz := gzip.NewWriter(f)
+		if _, err = gz.Write(data); err == nil {
+			err = gz.Close()
+		}
+	} else {
+		_, err = f.Write(data)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,144 @@
+// msak-join merges the client-side and server-side results of each TCP flow
+// into a single JSON document per flow, written as JSON lines.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/m-lab/go/rtx"
+	"github.com/robertodauria/msak/pkg/ndtm/archive"
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+var (
+	flagClient    = flag.String("client", "", "Directory containing the client's results")
+	flagServer    = flag.String("server", "", "Directory containing the server's results")
+	flagOutput    = flag.String("output", "", "File to write the joined flows to (default: stdout)")
+	flagUnmatched = flag.Bool("unmatched", false, "Also output the results that have no matching peer result")
+	flagMID       = flag.String("mid", "", "Only join the results of this measurement ID")
+	flagFrom      = flag.String("from", "", "Only join the results archived on or after this date (YYYY-MM-DD, UTC)")
+	flagTo        = flag.String("to", "", "Only join the results archived on or before this date (YYYY-MM-DD, UTC)")
+)
+
+// Flow contains the results archived by the client and by the server for the
+// same TCP flow. Either can be nil for unmatched results.
+type Flow struct {
+	MeasurementID string
+	SubTest       string
+	ClientUUID    string
+	ServerUUID    string
+	Client        *results.NDTMResult `json:",omitempty"`
+	Server        *results.NDTMResult `json:",omitempty"`
+}
+
+func main() {
+	flag.Parse()
+	if *flagClient == "" || *flagServer == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	filter := archive.Filter{MeasurementID: *flagMID}
+	from, err := parseDate(*flagFrom)
+	rtx.Must(err, "Invalid -from")
+	filter.From = from
+	to, err := parseDate(*flagTo)
+	rtx.Must(err, "Invalid -to")
+	if !to.IsZero() {
+		filter.To = to.AddDate(0, 0, 1)
+	}
+
+	clientResults, err := readResults(*flagClient, filter)
+	rtx.Must(err, "Cannot read client results")
+	serverResults, err := readResults(*flagServer, filter)
+	rtx.Must(err, "Cannot read server results")
+
+	out := os.Stdout
+	if *flagOutput != "" {
+		out, err = os.Create(*flagOutput)
+		rtx.Must(err, "Cannot create output file")
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+
+	for _, f := range join(clientResults, serverResults, *flagUnmatched) {
+		rtx.Must(enc.Encode(f), "Cannot write flow")
+	}
+}
+
+// join matches client and server results by their UUID and PeerUUID. Each
+// endpoint records the other's UUID, so a flow is matched as long as either
+// of them does.
+func join(clientResults, serverResults []*results.NDTMResult, unmatched bool) []*Flow {
+	byUUID := map[string]*results.NDTMResult{}
+	byPeerUUID := map[string]*results.NDTMResult{}
+	for _, r := range serverResults {
+		byUUID[r.UUID] = r
+		if r.PeerUUID != "" {
+			byPeerUUID[r.PeerUUID] = r
+		}
+	}
+
+	var flows []*Flow
+	matched := map[*results.NDTMResult]bool{}
+	for _, c := range clientResults {
+		s := byUUID[c.PeerUUID]
+		if s == nil || c.PeerUUID == "" {
+			s = byPeerUUID[c.UUID]
+		}
+		if s == nil && !unmatched {
+			continue
+		}
+		f := &Flow{
+			MeasurementID: c.MeasurementID,
+			SubTest:       c.SubTest,
+			ClientUUID:    c.UUID,
+			Client:        c,
+		}
+		if s != nil {
+			matched[s] = true
+			f.ServerUUID = s.UUID
+			f.Server = s
+		}
+		flows = append(flows, f)
+	}
+	if unmatched {
+		for _, s := range serverResults {
+			if matched[s] {
+				continue
+			}
+			flows = append(flows, &Flow{
+				MeasurementID: s.MeasurementID,
+				SubTest:       s.SubTest,
+				ServerUUID:    s.UUID,
+				Server:        s,
+			})
+		}
+	}
+	return flows
+}
+
+// readResults reads the results under the data directory dir matching f.
+// Files that cannot be read are skipped with a warning.
+func readResults(dir string, f archive.Filter) ([]*results.NDTMResult, error) {
+	res, skipped, err := archive.ReadAll(dir, f)
+	for _, e := range skipped {
+		log.Printf("Skipping %v", e)
+	}
+	return res, err
+}
+
+// parseDate parses a YYYY-MM-DD date, returning the zero time for s == "".
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
@@ -3,9 +3,13 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/m-lab/access/controller"
@@ -14,7 +18,12 @@ import (
 	"github.com/m-lab/go/httpx"
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/rtx"
+	"github.com/robertodauria/msak/internal/auth"
+	"github.com/robertodauria/msak/internal/congestion"
 	"github.com/robertodauria/msak/internal/handler"
+	"github.com/robertodauria/msak/internal/netx"
+	"github.com/robertodauria/msak/internal/persistence"
+	"github.com/robertodauria/msak/pkg/ndtm"
 	"github.com/robertodauria/msak/pkg/ndtm/spec"
 	"go.uber.org/zap"
 )
@@ -26,6 +35,16 @@ var (
 	flagEndpointCleartext = flag.String("ws_addr", ":8080", "Listen address/port for cleartext connections")
 	flagDataDir           = flag.String("datadir", "./data", "Directory to store data in")
 	flagDebug             = flag.Bool("debug", false, "Enable info/debug output")
+	flagMaxActive         = flag.Int64("max-active", 0, "Maximum number of concurrent measurements, each stream counting as one (0 for no limit)")
+	flagMeasurementBuffer = flag.Int("measurements.buffer", ndtm.DefaultDeliveryPolicy.BufferSize, "Number of measurements buffered for each flow")
+	flagDelivery          = flag.String("measurements.delivery", string(ndtm.DefaultDeliveryPolicy.Mode), "What to do with measurements when the buffer is full: drop or block")
+	flagArchiveFormat     = flag.String("archive.format", string(persistence.FormatJSON), "Format to save results in: json or compact")
+	flagFDCheckInterval   = flag.Duration("fdcheck.interval", time.Minute, "Interval between file descriptor leak checks (0 to disable)")
+	flagAuthMTLSCA        = flag.String("auth.mtls-ca", "", "PEM file with the CAs to verify client certificates with (enables mTLS authentication)")
+	flagAuthAPIKeys       = flag.String("auth.apikeys", "", "File with one \"<name> <key>\" API key per line (enables API key authentication)")
+	flagAuthHMACKeys      = flag.String("auth.hmac-keys", "", "File with one \"<key ID> <secret>\" pair per line (enables signed URL authentication)")
+	flagCCAllowed         = flagx.StringArray{}
+	flagOriginsAllowed    = flagx.StringArray{}
 	tokenVerifyKey        = flagx.FileBytesArray{}
 	tokenVerify           bool
 	tokenMachine          string
@@ -35,6 +54,8 @@ var (
 )
 
 func init() {
+	flag.Var(&flagCCAllowed, "cc.allowed", "Congestion control algorithms clients can request (default: all the ones this process can set)")
+	flag.Var(&flagOriginsAllowed, "origins.allowed", "Origins browser clients can connect from: *, origins (https://example.com), hosts (example.com) or wildcard domains (*.example.com) (default: all)")
 
 	flag.Var(&tokenVerifyKey, "token.verify-key", "Public key for verifying access tokens")
 	flag.BoolVar(&tokenVerify, "token.verify", false, "Verify access tokens")
@@ -42,12 +63,21 @@ func init() {
 }
 
 // httpServer creates a new *http.Server with explicit Read and Write timeouts.
-func httpServer(addr string, handler http.Handler) *http.Server {
+func httpServer(addr string, handler http.Handler, clientCAs *x509.CertPool) *http.Server {
 	tlsconf := &tls.Config{}
+	if clientCAs != nil {
+		// Client certificates are optional at the TLS layer: requests
+		// without one can still be authenticated by other means.
+		tlsconf.ClientCAs = clientCAs
+		tlsconf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
 	return &http.Server{
 		Addr:      addr,
 		Handler:   handler,
 		TLSConfig: tlsconf,
+		// Make the connection available to handlers, so that they can read
+		// the flow's UUID before upgrading it.
+		ConnContext: netx.WithConn,
 		// NOTE: set absolute read and write timeouts for server connections.
 		// This prevents clients, or middleboxes, from opening a connection and
 		// holding it open indefinitely. This applies equally to TLS and non-TLS
@@ -57,6 +87,116 @@ func httpServer(addr string, handler http.Handler) *http.Server {
 	}
 }
 
+// authenticator returns the Authenticator configured via the -auth.* flags
+// and the pool of CAs to verify client certificates with, if any. If no
+// authentication method is enabled, the returned Authenticator is nil.
+func authenticator() (auth.Authenticator, *x509.CertPool, error) {
+	var chain auth.Chain
+	var pool *x509.CertPool
+	if *flagAuthMTLSCA != "" {
+		pem, err := os.ReadFile(*flagAuthMTLSCA)
+		if err != nil {
+			return nil, nil, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates found in %s", *flagAuthMTLSCA)
+		}
+		chain = append(chain, auth.MTLS{})
+	}
+	if *flagAuthAPIKeys != "" {
+		keys, err := auth.LoadAPIKeys(*flagAuthAPIKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append(chain, keys)
+	}
+	if *flagAuthHMACKeys != "" {
+		signed, err := auth.LoadSignedURLs(*flagAuthHMACKeys)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append(chain, signed)
+	}
+	if len(chain) == 0 {
+		return nil, nil, nil
+	}
+	return chain, pool, nil
+}
+
+// allowedCC returns the congestion control algorithms clients can request.
+// Processes running as root can set any available algorithm, others only the
+// ones in tcp_allowed_congestion_control. If restrict is not empty, the result
+// is restricted to its elements, which must all be settable.
+func allowedCC(restrict []string) ([]string, error) {
+	settable, err := congestion.Available()
+	if err == nil && os.Geteuid() != 0 {
+		settable, err = congestion.Allowed()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(restrict) == 0 {
+		return settable, nil
+	}
+	var res []string
+	for _, cc := range restrict {
+		if !flagx.StringArray(settable).Contains(cc) {
+			return nil, fmt.Errorf("congestion control algorithm %q cannot be set on this system", cc)
+		}
+		res = append(res, cc)
+	}
+	return res, nil
+}
+
+// fdLeakChecks is the number of consecutive idle checks the number of open
+// file descriptors must grow at before a leak is reported.
+const fdLeakChecks = 3
+
+// checkFDLeaks periodically counts the open file descriptors while no
+// measurement is running. Idle keep-alive connections, the metrics listener
+// and pending TLS handshakes make the count vary, so a possible leak is only
+// logged when it grows at fdLeakChecks consecutive idle checks.
+func checkFDLeaks(ctx context.Context, h *handler.Handler, interval time.Duration) {
+	if _, err := netx.OpenFiles(); err != nil {
+		zap.L().Sugar().Warnf("File descriptor leak check disabled: %v", err)
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// first is the count at the start of the current growth streak, prev
+	// the count at the previous idle check, or -1.
+	first, prev, growth := -1, -1, 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if h.Active() != 0 {
+			continue
+		}
+		n, err := netx.OpenFiles()
+		if err != nil {
+			zap.L().Sugar().Warnf("Cannot count open file descriptors: %v", err)
+			continue
+		}
+		if prev >= 0 && n > prev {
+			growth++
+		} else {
+			first, growth = n, 0
+		}
+		prev = n
+		if growth >= fdLeakChecks {
+			zap.L().Sugar().Warnw("Possible file descriptor leak",
+				"open", n,
+				"baseline", first,
+				"checks", growth)
+			first, growth = n, 0
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -80,14 +220,44 @@ func main() {
 	}
 	acm, _ := controller.Setup(ctx, v, tokenVerify, tokenMachine, nil, ndtmTokenPaths)
 
+	// Discover the congestion control algorithms clients can request. If the
+	// system does not support setting them, requests are not validated.
+	ccList, err := allowedCC(flagCCAllowed)
+	if errors.Is(err, congestion.ErrNoSupport) {
+		zap.L().Sugar().Warn("Cannot list congestion control algorithms, requests will not be validated")
+		ccList = nil
+	} else {
+		rtx.Must(err, "Cannot list congestion control algorithms")
+		zap.L().Sugar().Info("Allowed congestion control algorithms: ", ccList)
+	}
+
+	origins, err := ndtm.NewOriginPolicy(flagOriginsAllowed)
+	rtx.Must(err, "Invalid -origins.allowed")
+
+	delivery := ndtm.DeliveryPolicy{
+		BufferSize: *flagMeasurementBuffer,
+		Mode:       ndtm.DeliveryMode(*flagDelivery),
+	}
+	rtx.Must(delivery.Validate(), "Invalid measurement delivery policy")
+
+	format, err := persistence.ParseFormat(*flagArchiveFormat)
+	rtx.Must(err, "Invalid -archive.format")
+
+	authn, clientCAs, err := authenticator()
+	rtx.Must(err, "Cannot set up authentication")
+
 	// The ndtm handler serving up ndtm tests.
 	ndtmMux := http.NewServeMux()
-	ndtmHandler := handler.New(*flagDataDir)
+	ndtmHandler := handler.New(*flagDataDir, ccList, origins, *flagMaxActive, delivery, format)
 	ndtmMux.Handle(spec.DownloadPath, http.HandlerFunc(ndtmHandler.Download))
 	ndtmMux.Handle(spec.UploadPath, http.HandlerFunc(ndtmHandler.Upload))
+	var ndtmRoot http.Handler = ndtmMux
+	if authn != nil {
+		ndtmRoot = auth.Handler(authn, ndtmMux)
+	}
 	ndtmServerCleartext := httpServer(
 		*flagEndpointCleartext,
-		acm.Then(ndtmMux))
+		acm.Then(ndtmRoot), nil)
 
 	zap.L().Sugar().Info("About to listen for ws tests on " + *flagEndpointCleartext)
 	rtx.Must(httpx.ListenAndServeAsync(ndtmServerCleartext), "Could not start cleartext server")
@@ -96,12 +266,16 @@ func main() {
 	if *flagCertFile != "" && *flagKeyFile != "" {
 		ndt7Server := httpServer(
 			*flagEndpoint,
-			acm.Then(ndtmMux))
+			acm.Then(ndtmRoot), clientCAs)
 		log.Println("About to listen for wss tests on " + *flagEndpoint)
 		rtx.Must(httpx.ListenAndServeTLSAsync(ndt7Server, *flagCertFile, *flagKeyFile), "Could not start TLS server")
 		defer ndt7Server.Close()
 	}
 
+	if *flagFDCheckInterval > 0 {
+		go checkFDLeaks(ctx, ndtmHandler, *flagFDCheckInterval)
+	}
+
 	<-ctx.Done()
 	cancel()
 }
@@ -0,0 +1,34 @@
+// msak-sign prints a URL signed for msak-server's signed URL authentication.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/robertodauria/msak/internal/auth"
+)
+
+var (
+	flagURL    = flag.String("url", "", "URL to sign, e.g. wss://host:4443/msak/ndtm/download?mid=...")
+	flagKeyID  = flag.String("kid", "", "ID of the key to sign with")
+	flagSecret = flag.String("secret", "", "Secret of the key to sign with")
+	flagTTL    = flag.Duration("ttl", time.Hour, "How long the signed URL stays valid")
+)
+
+func main() {
+	flag.Parse()
+	if *flagURL == "" || *flagKeyID == "" || *flagSecret == "" {
+		fmt.Fprintln(os.Stderr, "-url, -kid and -secret are required")
+		os.Exit(2)
+	}
+	u, err := url.Parse(*flagURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid URL: %v\n", err)
+		os.Exit(1)
+	}
+	auth.Sign(u, *flagKeyID, []byte(*flagSecret), time.Now().Add(*flagTTL))
+	fmt.Println(u.String())
+}
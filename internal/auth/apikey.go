@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+const (
+	// APIKeyHeader is the header carrying an API key.
+	APIKeyHeader = "X-Msak-Api-Key"
+
+	// APIKeyParam is the querystring parameter carrying an API key, for
+	// clients that cannot set headers (e.g. browsers).
+	APIKeyParam = "key"
+)
+
+// APIKeys authenticates clients presenting one of a set of static keys.
+type APIKeys struct {
+	// keys maps each key's name to the key.
+	keys map[string]string
+}
+
+// NewAPIKeys returns an APIKeys accepting the given keys, indexed by name.
+func NewAPIKeys(keys map[string]string) *APIKeys {
+	return &APIKeys{keys: keys}
+}
+
+// LoadAPIKeys reads the keys from a file containing one "<name> <key>" pair
+// per line.
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	keys, err := loadKeys(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewAPIKeys(keys), nil
+}
+
+// Authenticate implements Authenticator. The identity's subject is the name
+// of the key.
+func (a *APIKeys) Authenticate(req *http.Request) (*results.Identity, error) {
+	key := req.Header.Get(APIKeyHeader)
+	if key == "" {
+		key = req.URL.Query().Get(APIKeyParam)
+	}
+	if key == "" {
+		return nil, ErrNoCredentials
+	}
+	// Compare against every key, in constant time, so that the time taken
+	// does not reveal anything about the valid ones.
+	var subject string
+	for name, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			subject = name
+		}
+	}
+	if subject == "" {
+		return nil, ErrInvalidCredentials
+	}
+	return &results.Identity{
+		Method:  "apikey",
+		Subject: subject,
+	}, nil
+}
@@ -0,0 +1,77 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      string
+		param       string
+		wantSubject string
+		wantErr     error
+	}{
+		{
+			name:        "header",
+			header:      "key-a",
+			wantSubject: "alice",
+		},
+		{
+			name:        "param",
+			param:       "key-b",
+			wantSubject: "bob",
+		},
+		{
+			name:        "header-before-param",
+			header:      "key-a",
+			param:       "key-b",
+			wantSubject: "alice",
+		},
+		{
+			name:    "invalid-header",
+			header:  "key-c",
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "invalid-param",
+			param:   "key-a-",
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "invalid-header-valid-param",
+			header:  "key-c",
+			param:   "key-b",
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "none",
+			wantErr: ErrNoCredentials,
+		},
+	}
+	a := NewAPIKeys(map[string]string{"alice": "key-a", "bob": "key-b"})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/ndtm/v0/download?mid=m1"
+			if tt.param != "" {
+				target += "&" + APIKeyParam + "=" + tt.param
+			}
+			req := httptest.NewRequest("GET", target, nil)
+			if tt.header != "" {
+				req.Header.Set(APIKeyHeader, tt.header)
+			}
+			id, err := a.Authenticate(req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if id.Method != "apikey" || id.Subject != tt.wantSubject {
+				t.Errorf("Authenticate() = %+v, want apikey/%s", id, tt.wantSubject)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+// Package auth provides pluggable authentication for the ndtm endpoints.
+package auth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+	"go.uber.org/zap"
+)
+
+var (
+	// ErrNoCredentials is returned by an Authenticator if the request does
+	// not carry the kind of credentials it checks.
+	ErrNoCredentials = errors.New("no credentials")
+
+	// ErrInvalidCredentials is returned by an Authenticator if the request
+	// carries credentials that cannot be verified.
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Authenticator verifies the credentials of an HTTP request.
+type Authenticator interface {
+	// Authenticate returns the identity of the client making the request.
+	// It returns ErrNoCredentials if the request does not carry the kind of
+	// credentials this Authenticator checks, so that others can be tried.
+	Authenticate(req *http.Request) (*results.Identity, error)
+}
+
+// Chain is an Authenticator trying each of its elements in order. The first
+// one finding credentials in the request decides the outcome.
+type Chain []Authenticator
+
+// Authenticate implements Authenticator.
+func (c Chain) Authenticate(req *http.Request) (*results.Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(req)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return id, err
+	}
+	return nil, ErrNoCredentials
+}
+
+type contextKey struct{}
+
+// FromContext returns the identity stored in ctx by Handler, or nil.
+func FromContext(ctx context.Context) *results.Identity {
+	id, _ := ctx.Value(contextKey{}).(*results.Identity)
+	return id
+}
+
+// Handler returns an http.Handler rejecting requests that a cannot
+// authenticate with 401 Unauthorized. Authenticated requests are passed to
+// next with the client's identity in their context.
+func Handler(a Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		id, err := a.Authenticate(req)
+		if err != nil {
+			// TODO: increase a prometheus counter here.
+			zap.L().Sugar().Infow("Authentication failed",
+				"url", req.URL.Path,
+				"client", req.RemoteAddr,
+				"error", err)
+			rw.Header().Set("Connection", "Close")
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(req.Context(), contextKey{}, id)
+		next.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// loadKeys reads a file containing one "<name> <key>" pair per line. Empty
+// lines and lines starting with # are ignored.
+func loadKeys(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := map[string]string{}
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"<name> <key>\"", path, n)
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return nil, fmt.Errorf("%s:%d: duplicate name %q", path, n, fields[0])
+		}
+		keys[fields[0]] = fields[1]
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys found", path)
+	}
+	return keys, nil
+}
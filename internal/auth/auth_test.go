@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+// fakeAuth is an Authenticator returning a fixed outcome and counting its
+// calls.
+type fakeAuth struct {
+	id    *results.Identity
+	err   error
+	calls int
+}
+
+func (f *fakeAuth) Authenticate(*http.Request) (*results.Identity, error) {
+	f.calls++
+	return f.id, f.err
+}
+
+func TestChain(t *testing.T) {
+	alice := &results.Identity{Method: "fake", Subject: "alice"}
+	bob := &results.Identity{Method: "fake", Subject: "bob"}
+	tests := []struct {
+		name      string
+		chain     []*fakeAuth
+		want      *results.Identity
+		wantErr   error
+		wantCalls []int
+	}{
+		{
+			name:      "first",
+			chain:     []*fakeAuth{{id: alice}, {id: bob}},
+			want:      alice,
+			wantCalls: []int{1, 0},
+		},
+		{
+			name:      "falls-through-no-credentials",
+			chain:     []*fakeAuth{{err: ErrNoCredentials}, {id: bob}},
+			want:      bob,
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:      "stops-on-invalid-credentials",
+			chain:     []*fakeAuth{{err: ErrInvalidCredentials}, {id: bob}},
+			wantErr:   ErrInvalidCredentials,
+			wantCalls: []int{1, 0},
+		},
+		{
+			name:      "none",
+			chain:     []*fakeAuth{{err: ErrNoCredentials}, {err: ErrNoCredentials}},
+			wantErr:   ErrNoCredentials,
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:    "empty",
+			wantErr: ErrNoCredentials,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Chain
+			for _, a := range tt.chain {
+				c = append(c, a)
+			}
+			id, err := c.Authenticate(httptest.NewRequest("GET", "/", nil))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if id != tt.want {
+				t.Errorf("Authenticate() = %+v, want %+v", id, tt.want)
+			}
+			for i, a := range tt.chain {
+				if a.calls != tt.wantCalls[i] {
+					t.Errorf("authenticator #%d called %d times, want %d", i, a.calls, tt.wantCalls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	alice := &results.Identity{Method: "fake", Subject: "alice"}
+	tests := []struct {
+		name       string
+		auth       Authenticator
+		wantStatus int
+		wantID     *results.Identity
+	}{
+		{
+			name:       "authenticated",
+			auth:       &fakeAuth{id: alice},
+			wantStatus: http.StatusOK,
+			wantID:     alice,
+		},
+		{
+			name:       "no-credentials",
+			auth:       &fakeAuth{err: ErrNoCredentials},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "invalid-credentials",
+			auth:       &fakeAuth{err: ErrInvalidCredentials},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called bool
+			var gotID *results.Identity
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				called = true
+				gotID = FromContext(req.Context())
+			})
+			rw := httptest.NewRecorder()
+			Handler(tt.auth, next).ServeHTTP(rw, httptest.NewRequest("GET", "/ndtm/v0/download", nil))
+			if rw.Code != tt.wantStatus {
+				t.Errorf("Handler() status = %d, want %d", rw.Code, tt.wantStatus)
+			}
+			if called != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("Handler() called next = %v, want %v", called, !called)
+			}
+			if gotID != tt.wantID {
+				t.Errorf("FromContext() = %+v, want %+v", gotID, tt.wantID)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignedURLs(t *testing.T) {
+	now := time.Date(2023, 5, 4, 10, 0, 0, 0, time.UTC)
+	secret := []byte("s3cret")
+	signed := func(path, mid string, expires time.Time) url.Values {
+		u := &url.URL{Path: path, RawQuery: url.Values{"mid": {mid}}.Encode()}
+		Sign(u, "k1", secret, expires)
+		return u.Query()
+	}
+	tests := []struct {
+		name    string
+		path    string
+		query   url.Values
+		wantErr error
+	}{
+		{
+			name:  "valid",
+			path:  "/ndtm/v0/download",
+			query: signed("/ndtm/v0/download", "m1", now.Add(time.Minute)),
+		},
+		{
+			name: "valid-extra-params",
+			path: "/ndtm/v0/download",
+			query: func() url.Values {
+				q := signed("/ndtm/v0/download", "m1", now.Add(time.Minute))
+				q.Set("cc", "bbr")
+				return q
+			}(),
+		},
+		{
+			name:  "expires-now",
+			path:  "/ndtm/v0/download",
+			query: signed("/ndtm/v0/download", "m1", now),
+		},
+		{
+			name:    "expired",
+			path:    "/ndtm/v0/download",
+			query:   signed("/ndtm/v0/download", "m1", now.Add(-time.Second)),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "no-signature",
+			path:    "/ndtm/v0/download",
+			query:   url.Values{"mid": {"m1"}},
+			wantErr: ErrNoCredentials,
+		},
+		{
+			name: "unknown-kid",
+			path: "/ndtm/v0/download",
+			query: func() url.Values {
+				q := signed("/ndtm/v0/download", "m1", now.Add(time.Minute))
+				q.Set(KeyIDParam, "k2")
+				return q
+			}(),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "tampered-path",
+			path:    "/ndtm/v0/upload",
+			query:   signed("/ndtm/v0/download", "m1", now.Add(time.Minute)),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name: "tampered-mid",
+			path: "/ndtm/v0/download",
+			query: func() url.Values {
+				q := signed("/ndtm/v0/download", "m1", now.Add(time.Minute))
+				q.Set("mid", "m2")
+				return q
+			}(),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name: "tampered-expires",
+			path: "/ndtm/v0/download",
+			query: func() url.Values {
+				q := signed("/ndtm/v0/download", "m1", now.Add(time.Minute))
+				q.Set(ExpiresParam, "99999999999")
+				return q
+			}(),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name: "malformed-expires",
+			path: "/ndtm/v0/download",
+			query: func() url.Values {
+				q := signed("/ndtm/v0/download", "m1", now.Add(time.Minute))
+				q.Set(ExpiresParam, "tomorrow")
+				return q
+			}(),
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name: "malformed-signature",
+			path: "/ndtm/v0/download",
+			query: func() url.Values {
+				q := signed("/ndtm/v0/download", "m1", now.Add(time.Minute))
+				q.Set(SignatureParam, "not-hex")
+				return q
+			}(),
+			wantErr: ErrInvalidCredentials,
+		},
+	}
+	s := NewSignedURLs(map[string][]byte{"k1": secret})
+	s.now = func() time.Time { return now }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path+"?"+tt.query.Encode(), nil)
+			id, err := s.Authenticate(req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if id != nil {
+					t.Errorf("Authenticate() = %+v, want nil", id)
+				}
+				return
+			}
+			if id.Method != "hmac" || id.Subject != "k1" {
+				t.Errorf("Authenticate() = %+v, want hmac/k1", id)
+			}
+		})
+	}
+}
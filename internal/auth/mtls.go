@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+// MTLS authenticates clients presenting a TLS certificate verified by the
+// server. The server's tls.Config must set ClientCAs and a ClientAuth policy
+// verifying the certificates it receives.
+type MTLS struct{}
+
+// Authenticate implements Authenticator. The identity's subject is the
+// certificate's subject.
+func (MTLS) Authenticate(req *http.Request) (*results.Identity, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil, ErrNoCredentials
+	}
+	if len(req.TLS.VerifiedChains) == 0 {
+		return nil, ErrInvalidCredentials
+	}
+	return &results.Identity{
+		Method:  "mtls",
+		Subject: req.TLS.VerifiedChains[0][0].Subject.String(),
+	}, nil
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMTLS(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client", Organization: []string{"msak"}}}
+	tests := []struct {
+		name        string
+		state       *tls.ConnectionState
+		wantSubject string
+		wantErr     error
+	}{
+		{
+			name: "verified",
+			state: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+				VerifiedChains:   [][]*x509.Certificate{{cert}},
+			},
+			wantSubject: "CN=client,O=msak",
+		},
+		{
+			name: "unverified",
+			state: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+			},
+			wantErr: ErrInvalidCredentials,
+		},
+		{
+			name:    "no-certificate",
+			state:   &tls.ConnectionState{},
+			wantErr: ErrNoCredentials,
+		},
+		{
+			name:    "no-tls",
+			wantErr: ErrNoCredentials,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ndtm/v0/download?mid=m1", nil)
+			req.TLS = tt.state
+			id, err := MTLS{}.Authenticate(req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if id.Method != "mtls" || id.Subject != tt.wantSubject {
+				t.Errorf("Authenticate() = %+v, want mtls/%s", id, tt.wantSubject)
+			}
+		})
+	}
+}
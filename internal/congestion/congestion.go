@@ -1,11 +1,12 @@
 // Package congestion contains code required to set the congestion control
-// algorithm and read BBR variables of a net.Conn. This code currently only
-// works on Linux systems, as BBR is only available there.
+// algorithm and read BBR, Vegas and DCTCP variables of a net.Conn. This code
+// currently only works on Linux systems, as TCP_CC_INFO is only available
+// there. It does not require cgo.
 package congestion
 
 import (
 	"errors"
-	"os"
+	"syscall"
 
 	"github.com/m-lab/tcp-info/inetdiag"
 )
@@ -13,16 +14,42 @@ import (
 // ErrNoSupport indicates that this system does not support BBR.
 var ErrNoSupport = errors.New("TCP_CC_INFO not supported")
 
-// Enable sets the congestion control algorithm for |fp|.
-func Set(fp *os.File, cc string) error {
-	return set(fp, cc)
+// Available returns the congestion control algorithms available on this
+// system, as listed in tcp_available_congestion_control.
+func Available() ([]string, error) {
+	return available()
 }
 
-func Get(fp *os.File) (string, error) {
-	return get(fp)
+// Allowed returns the congestion control algorithms that processes without
+// CAP_NET_ADMIN are allowed to set, as listed in
+// tcp_allowed_congestion_control.
+func Allowed() ([]string, error) {
+	return allowed()
 }
 
-// GetBBRInfo obtains BBR info from |fp|.
-func GetBBRInfo(fp *os.File) (inetdiag.BBRInfo, error) {
-	return getMaxBandwidthAndMinRTT(fp)
+// Set sets the congestion control algorithm for |rc|.
+func Set(rc syscall.RawConn, cc string) error {
+	return set(rc, cc)
+}
+
+// Get returns the congestion control algorithm used by |rc|.
+func Get(rc syscall.RawConn) (string, error) {
+	return get(rc)
+}
+
+// GetBBRInfo obtains BBR info from |rc|.
+func GetBBRInfo(rc syscall.RawConn) (inetdiag.BBRInfo, error) {
+	return getMaxBandwidthAndMinRTT(rc)
+}
+
+// GetVegasInfo obtains Vegas info from |rc|. Since Vegas and DCTCP info have
+// the same size, callers should check the algorithm in use with Get first.
+func GetVegasInfo(rc syscall.RawConn) (inetdiag.VegasInfo, error) {
+	return getVegasInfo(rc)
+}
+
+// GetDCTCPInfo obtains DCTCP info from |rc|. Since Vegas and DCTCP info have
+// the same size, callers should check the algorithm in use with Get first.
+func GetDCTCPInfo(rc syscall.RawConn) (inetdiag.DCTCPInfo, error) {
+	return getDCTCPInfo(rc)
 }
@@ -1,30 +1,64 @@
 package congestion
 
-// #include <linux/inet_diag.h>
-// #include <netinet/ip.h>
-// #include <netinet/tcp.h>
-// #include <stdlib.h>
-import "C"
-
 import (
+	"encoding/binary"
 	"math"
 	"os"
+	"strings"
 	"syscall"
 	"unsafe"
 
 	"github.com/m-lab/tcp-info/inetdiag"
-	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// Sizes of the structures returned by TCP_CC_INFO, as defined in
+// include/uapi/linux/inet_diag.h. The size of union tcp_cc_info is the size
+// of its largest member, struct tcp_bbr_info.
+const (
+	sizeofTCPVegasInfo = 16
+	sizeofTCPDCTCPInfo = 16
+	sizeofTCPBBRInfo   = 20
+	sizeofTCPCCInfo    = sizeofTCPBBRInfo
 )
 
-func set(fp *os.File, cc string) error {
-	rawconn, err := fp.SyscallConn()
+// nativeEndian is the byte order used by the kernel for the structures
+// returned by getsockopt.
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+const (
+	availablePath = "/proc/sys/net/ipv4/tcp_available_congestion_control"
+	allowedPath   = "/proc/sys/net/ipv4/tcp_allowed_congestion_control"
+)
+
+func available() ([]string, error) {
+	return readList(availablePath)
+}
+
+func allowed() ([]string, error) {
+	return readList(allowedPath)
+}
+
+// readList reads a space-separated list of algorithms from a sysctl file.
+func readList(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return strings.Fields(string(data)), nil
+}
+
+func set(rc syscall.RawConn, cc string) error {
 	var syscallErr error
-	err = rawconn.Control(func(fd uintptr) {
+	err := rc.Control(func(fd uintptr) {
 		// Note: Fd() returns uintptr but on Unix we can safely use int for sockets.
-		syscallErr = syscall.SetsockoptString(int(fd), syscall.IPPROTO_TCP, syscall.TCP_CONGESTION, cc)
+		syscallErr = unix.SetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION, cc)
 	})
 	if err != nil {
 		return err
@@ -32,86 +66,156 @@ func set(fp *os.File, cc string) error {
 	return syscallErr
 }
 
-func get(fp *os.File) (string, error) {
-	rawconn, err := fp.SyscallConn()
-	if err != nil {
-		return "", err
-	}
-	var syscallErr syscall.Errno
-	cc := [16]byte{}
-	cclen := len(cc)
-	err = rawconn.Control(func(fd uintptr) {
-		_, _, syscallErr = syscall.Syscall6(
-			uintptr(syscall.SYS_GETSOCKOPT),
-			fd,
-			uintptr(syscall.IPPROTO_TCP),
-			uintptr(syscall.TCP_CONGESTION),
-			uintptr(unsafe.Pointer(&cc)),
-			uintptr(unsafe.Pointer(&cclen)),
-			uintptr(0),
-		)
+func get(rc syscall.RawConn) (string, error) {
+	var (
+		cc         string
+		syscallErr error
+	)
+	err := rc.Control(func(fd uintptr) {
+		cc, syscallErr = unix.GetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION)
 	})
 	if err != nil {
 		return "", err
 	}
-	if syscallErr != 0 {
-		zap.L().Sugar().Error(syscallErr)
+	if syscallErr != nil {
 		return "", syscallErr
 	}
-	return C.GoString((*C.char)(unsafe.Pointer(&cc))), nil
+	// The kernel returns a NUL-padded TCP_CA_NAME_MAX bytes buffer.
+	if i := strings.IndexByte(cc, 0); i >= 0 {
+		cc = cc[:i]
+	}
+	return cc, nil
 }
 
-func getMaxBandwidthAndMinRTT(fp *os.File) (inetdiag.BBRInfo, error) {
-	cci := C.union_tcp_cc_info{}
-	size := uint32(C.sizeof_union_tcp_cc_info)
-	metrics := inetdiag.BBRInfo{}
-	rawconn, rawConnErr := fp.SyscallConn()
-	if rawConnErr != nil {
-		return metrics, rawConnErr
-	}
+// getCCInfo reads union tcp_cc_info from |rc|. The returned slice is only
+// as long as the structure written by the congestion control module, which
+// is zero for modules not providing any info (e.g. CUBIC).
+func getCCInfo(rc syscall.RawConn) ([]byte, error) {
+	buf := make([]byte, sizeofTCPCCInfo)
+	size := uint32(len(buf))
 	var syscallErr syscall.Errno
-	err := rawconn.Control(func(fd uintptr) {
-		_, _, syscallErr = syscall.Syscall6(
-			uintptr(syscall.SYS_GETSOCKOPT),
+	err := rc.Control(func(fd uintptr) {
+		_, _, syscallErr = unix.Syscall6(
+			unix.SYS_GETSOCKOPT,
 			fd,
-			uintptr(C.IPPROTO_TCP),
-			uintptr(C.TCP_CC_INFO),
-			uintptr(unsafe.Pointer(&cci)),
+			uintptr(unix.IPPROTO_TCP),
+			uintptr(unix.TCP_CC_INFO),
+			uintptr(unsafe.Pointer(&buf[0])),
 			uintptr(unsafe.Pointer(&size)),
 			uintptr(0))
 	})
 	if err != nil {
-		return metrics, err
+		return nil, err
 	}
 	if syscallErr != 0 {
-		// C.get_bbr_info returns ENOSYS when the system does not support BBR. In
-		// such case let us map the error to ErrNoSupport, such that this Linux
-		// system looks like any other system where BBR is not available. This way
-		// the code for dealing with this error is not platform dependent.
-		if syscallErr == syscall.ENOSYS {
-			return metrics, ErrNoSupport
+		// getsockopt fails with ENOSYS when the system does not support
+		// TCP_CC_INFO. In such case let us map the error to ErrNoSupport,
+		// such that this Linux system looks like any other system where it
+		// is not available. This way the code for dealing with this error is
+		// not platform dependent.
+		if syscallErr == syscall.ENOSYS || syscallErr == syscall.ENOPROTOOPT {
+			return nil, ErrNoSupport
 		}
-		return metrics, syscallErr
+		return nil, syscallErr
+	}
+	return buf[:size], nil
+}
+
+func getMaxBandwidthAndMinRTT(rc syscall.RawConn) (inetdiag.BBRInfo, error) {
+	buf, err := getCCInfo(rc)
+	if err != nil {
+		return inetdiag.BBRInfo{}, err
+	}
+	return decodeBBRInfo(buf)
+}
+
+func getVegasInfo(rc syscall.RawConn) (inetdiag.VegasInfo, error) {
+	buf, err := getCCInfo(rc)
+	if err != nil {
+		return inetdiag.VegasInfo{}, err
+	}
+	return decodeVegasInfo(buf)
+}
+
+func getDCTCPInfo(rc syscall.RawConn) (inetdiag.DCTCPInfo, error) {
+	buf, err := getCCInfo(rc)
+	if err != nil {
+		return inetdiag.DCTCPInfo{}, err
 	}
+	return decodeDCTCPInfo(buf)
+}
+
+// decodeBBRInfo decodes struct tcp_bbr_info:
+//
+//	struct tcp_bbr_info {
+//		__u32	bbr_bw_lo;
+//		__u32	bbr_bw_hi;
+//		__u32	bbr_min_rtt;
+//		__u32	bbr_pacing_gain;
+//		__u32	bbr_cwnd_gain;
+//	};
+func decodeBBRInfo(buf []byte) (inetdiag.BBRInfo, error) {
+	metrics := inetdiag.BBRInfo{}
 	// Apparently, tcp_bbr_info is the only congestion control data structure
 	// to occupy five 32 bit words. Currently, in September 2018, the other two
 	// data structures (i.e. Vegas and DCTCP) both occupy four 32 bit words.
 	//
 	// See include/uapi/linux/inet_diag.h in torvalds/linux@bbb6189d.
-	if size != C.sizeof_struct_tcp_bbr_info {
+	if len(buf) != sizeofTCPBBRInfo {
 		return metrics, syscall.EINVAL
 	}
-	bbrip := (*C.struct_tcp_bbr_info)(unsafe.Pointer(&cci[0]))
 	// Convert the values from the kernel provided units to the units that
 	// we're going to use in ndt7. The units we use are the most common ones
 	// in which people typically expects these variables.
-	maxbw := uint64(bbrip.bbr_bw_hi)<<32 | uint64(bbrip.bbr_bw_lo)
+	maxbw := uint64(nativeEndian.Uint32(buf[4:]))<<32 | uint64(nativeEndian.Uint32(buf[0:]))
 	if maxbw > math.MaxInt64 {
 		return metrics, syscall.EOVERFLOW
 	}
 	metrics.BW = int64(maxbw) // Java has no uint64
-	metrics.MinRTT = uint32(bbrip.bbr_min_rtt)
-	metrics.PacingGain = uint32(bbrip.bbr_pacing_gain)
-	metrics.CwndGain = uint32(bbrip.bbr_cwnd_gain)
+	metrics.MinRTT = nativeEndian.Uint32(buf[8:])
+	metrics.PacingGain = nativeEndian.Uint32(buf[12:])
+	metrics.CwndGain = nativeEndian.Uint32(buf[16:])
 	return metrics, nil
 }
+
+// decodeVegasInfo decodes struct tcpvegas_info:
+//
+//	struct tcpvegas_info {
+//		__u32	tcpv_enabled;
+//		__u32	tcpv_rttcnt;
+//		__u32	tcpv_rtt;
+//		__u32	tcpv_minrtt;
+//	};
+func decodeVegasInfo(buf []byte) (inetdiag.VegasInfo, error) {
+	if len(buf) != sizeofTCPVegasInfo {
+		return inetdiag.VegasInfo{}, syscall.EINVAL
+	}
+	return inetdiag.VegasInfo{
+		Enabled:  nativeEndian.Uint32(buf[0:]),
+		RTTCount: nativeEndian.Uint32(buf[4:]),
+		RTT:      nativeEndian.Uint32(buf[8:]),
+		MinRTT:   nativeEndian.Uint32(buf[12:]),
+	}, nil
+}
+
+// decodeDCTCPInfo decodes struct tcp_dctcp_info:
+//
+//	struct tcp_dctcp_info {
+//		__u16	dctcp_enabled;
+//		__u16	dctcp_ce_state;
+//		__u32	dctcp_alpha;
+//		__u32	dctcp_ab_ecn;
+//		__u32	dctcp_ab_tot;
+//	};
+func decodeDCTCPInfo(buf []byte) (inetdiag.DCTCPInfo, error) {
+	if len(buf) != sizeofTCPDCTCPInfo {
+		return inetdiag.DCTCPInfo{}, syscall.EINVAL
+	}
+	return inetdiag.DCTCPInfo{
+		Enabled: nativeEndian.Uint16(buf[0:]),
+		CEState: nativeEndian.Uint16(buf[2:]),
+		Alpha:   nativeEndian.Uint32(buf[4:]),
+		ABEcn:   nativeEndian.Uint32(buf[8:]),
+		ABTot:   nativeEndian.Uint32(buf[12:]),
+	}, nil
+}
@@ -4,19 +4,35 @@
 package congestion
 
 import (
-	"os"
+	"syscall"
 
 	"github.com/m-lab/tcp-info/inetdiag"
 )
 
-func set(*os.File, string) error {
+func available() ([]string, error) {
+	return nil, ErrNoSupport
+}
+
+func allowed() ([]string, error) {
+	return nil, ErrNoSupport
+}
+
+func set(syscall.RawConn, string) error {
 	return ErrNoSupport
 }
 
-func get(*os.File) (string, error) {
+func get(syscall.RawConn) (string, error) {
 	return "", ErrNoSupport
 }
 
-func getMaxBandwidthAndMinRTT(*os.File) (inetdiag.BBRInfo, error) {
+func getMaxBandwidthAndMinRTT(syscall.RawConn) (inetdiag.BBRInfo, error) {
 	return inetdiag.BBRInfo{}, ErrNoSupport
 }
+
+func getVegasInfo(syscall.RawConn) (inetdiag.VegasInfo, error) {
+	return inetdiag.VegasInfo{}, ErrNoSupport
+}
+
+func getDCTCPInfo(syscall.RawConn) (inetdiag.DCTCPInfo, error) {
+	return inetdiag.DCTCPInfo{}, ErrNoSupport
+}
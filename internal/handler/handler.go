@@ -3,14 +3,22 @@ package handler
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/websocket"
 	"github.com/m-lab/access/controller"
+	"github.com/m-lab/go/flagx"
 	"github.com/m-lab/go/prometheusx"
 	"github.com/m-lab/go/warnonerror"
-	"github.com/m-lab/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/robertodauria/msak/internal/auth"
 	"github.com/robertodauria/msak/internal/congestion"
 	"github.com/robertodauria/msak/internal/netx"
 	"github.com/robertodauria/msak/internal/persistence"
@@ -20,11 +28,57 @@ import (
 	"go.uber.org/zap"
 )
 
-var ErrNoMeasurementID = errors.New("no measurement ID specified in the request")
+var (
+	rejectedOrigins = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "msak_ndtm_rejected_origins_total",
+		Help: "Number of websocket upgrades rejected because of their origin.",
+	})
+	droppedMeasurements = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "msak_ndtm_dropped_measurements_total",
+		Help: "Number of measurements not recorded because the buffer was full.",
+	}, []string{"origin"})
+	invalidMeasurements = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "msak_ndtm_invalid_measurements_total",
+		Help: "Number of measurements received from clients that were discarded as invalid.",
+	}, []string{"reason"})
+	middleboxFlows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "msak_ndtm_middlebox_flows_total",
+		Help: "Number of flows where a buffering or proxying middlebox is likely.",
+	}, []string{"kind"})
+)
+
+var (
+	ErrNoMeasurementID = errors.New("no measurement ID specified in the request")
+	ErrUnsupportedCC   = errors.New("none of the requested congestion control algorithms is allowed")
+)
+
+// defaultCC is the congestion control algorithm used when the client does
+// not request one.
+const defaultCC = "bbr"
 
 // Handler handles the msak subtests.
 type Handler struct {
 	dataDir string
+
+	// allowedCC is the list of congestion control algorithms clients can
+	// request. If nil, requests are not validated.
+	allowedCC []string
+
+	// origins is the policy for the origins of browser clients.
+	origins *ndtm.OriginPolicy
+
+	// maxActive is the maximum number of concurrent measurements. Zero means
+	// no limit.
+	maxActive int64
+
+	// delivery defines how measurements are buffered.
+	delivery ndtm.DeliveryPolicy
+
+	// format is the format results are saved in.
+	format persistence.Format
+
+	// active is the number of measurements currently running.
+	active int64
 }
 
 // writeBadRequest sends a Bad Request response to the client using writer.
@@ -33,10 +87,21 @@ func writeBadRequest(writer http.ResponseWriter) {
 	writer.WriteHeader(http.StatusBadRequest)
 }
 
-// New creates a new Handler.
-func New(dataDir string) *Handler {
+// New creates a new Handler. Clients can only request the congestion control
+// algorithms in allowedCC. A nil allowedCC disables validation. Browser
+// clients must be allowed by origins, or any origin if nil. Measurements
+// exceeding maxActive concurrent ones are rejected, unless it is zero. The
+// measurements of each flow are buffered according to delivery, and its
+// result is saved in dataDir in the given format.
+func New(dataDir string, allowedCC []string, origins *ndtm.OriginPolicy, maxActive int64,
+	delivery ndtm.DeliveryPolicy, format persistence.Format) *Handler {
 	return &Handler{
-		dataDir: dataDir,
+		dataDir:   dataDir,
+		allowedCC: allowedCC,
+		origins:   origins,
+		maxActive: maxActive,
+		delivery:  delivery,
+		format:    format,
 	}
 }
 
@@ -50,13 +115,18 @@ func (h *Handler) Upload(rw http.ResponseWriter, req *http.Request) {
 	h.runMeasurement(spec.SubtestUpload, rw, req)
 }
 
+// Active returns the number of measurements currently running.
+func (h *Handler) Active() int64 {
+	return atomic.LoadInt64(&h.active)
+}
+
 func (h *Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter,
 	req *http.Request) {
 	// Does the request include a measurement id? If not, return.
 	mid, err := getMIDFromRequest(req)
 	if err != nil {
 		zap.L().Sugar().Infow("Received request without measurement id",
-			"url", req.URL.String(),
+			"url", req.URL.Path,
 			"client", req.RemoteAddr,
 			"error", err)
 		writeBadRequest(rw)
@@ -65,18 +135,74 @@ func (h *Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter,
 
 	zap.L().Sugar().Debug("mid: ", mid)
 
-	// Does the request include a custom cc? If not, use BBR.
-	requestCC := req.URL.Query().Get("cc")
-	if requestCC == "" {
-		requestCC = "bbr"
+	// Does the request ask for a clock offset estimation? If so, how many
+	// exchanges?
+	clockSync, err := getClockSyncFromRequest(req)
+	if err != nil {
+		zap.L().Sugar().Infow("Received request with invalid clock sync",
+			"url", req.URL.Path,
+			"client", req.RemoteAddr,
+			"error", err)
+		writeBadRequest(rw)
+		return
+	}
+
+	// Does the request ask for a compact encoding of measurement messages?
+	// Unknown encodings fall back to JSON.
+	enc := getEncodingFromRequest(req)
+
+	// Does the request include a custom cc? If so, keep the allowed
+	// algorithms in the client's preference list.
+	requestedCC := req.URL.Query().Get("cc")
+	candidates, err := h.selectCC(requestedCC)
+	if err != nil {
+		zap.L().Sugar().Infow("Received request with unsupported cc",
+			"url", req.URL.Path,
+			"client", req.RemoteAddr,
+			"error", err)
+		rw.Header().Set(spec.AvailableCCHeader, strings.Join(h.allowedCC, ","))
+		writeBadRequest(rw)
+		return
 	}
 
-	// Upgrade connection to websocket.
+	// The request is valid: from now on, it counts towards maxActive.
+	atomic.AddInt64(&h.active, 1)
+	defer atomic.AddInt64(&h.active, -1)
+
+	// Upgrade connection to websocket. Neither the querystring nor the
+	// headers are logged, since they can contain credentials.
 	zap.L().Sugar().Debugw("Upgrading connection to websocket",
-		"url", req.URL.String(),
-		"headers", req.Header,
+		"url", req.URL.Path,
+		"client", req.RemoteAddr,
 	)
-	conn, err := ndtm.Upgrade(rw, req)
+	// Let the client know the flow's UUID on the server side, so that the
+	// results archived by each endpoint can be joined.
+	header := http.Header{}
+	if uuid, err := getUUIDFromRequest(req); err == nil {
+		header.Set(spec.UUIDHeader, uuid)
+	} else if !errors.Is(err, netx.ErrNoSupport) {
+		zap.L().Sugar().Warnf("Cannot get the flow's UUID before upgrading: %v", err)
+	}
+	header.Set(spec.EncodingHeader, string(enc))
+	if clockSync > 0 {
+		header.Set(spec.ClockSyncHeader, strconv.Itoa(clockSync))
+	}
+
+	// Set the congestion control algorithm before upgrading, trying the
+	// candidates in order, so that the client can be told which algorithms
+	// are available if none of them can be set.
+	failedCC, ccErr := setCC(req, candidates)
+	if ccErr != nil && requestedCC != "" {
+		header.Set(spec.AvailableCCHeader, strings.Join(without(h.allowedCC, failedCC), ","))
+	}
+	conn, err := ndtm.Upgrade(rw, req, h.origins, header)
+	if errors.Is(err, ndtm.ErrOriginNotAllowed) {
+		rejectedOrigins.Inc()
+		zap.L().Sugar().Infow("Rejected websocket upgrade from disallowed origin",
+			"origin", req.Header.Get("Origin"),
+			"client", clientIP(req))
+		return
+	}
 	if err != nil {
 		// TODO: increase a prometheus counter here.
 		zap.L().Sugar().Warn("Websocket upgrade failed", err)
@@ -84,32 +210,51 @@ func (h *Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter,
 		return
 	}
 
-	// Make sure the connection is closed after (at most) MaxRuntime.
-	ctx, cancel := context.WithTimeout(req.Context(), spec.MaxRuntime)
+	// Refuse to start the measurement if too many are running already.
+	if h.maxActive > 0 && atomic.LoadInt64(&h.active) > h.maxActive {
+		zap.L().Sugar().Infow("Rejected measurement, server overloaded",
+			"client", clientIP(req),
+			"active", atomic.LoadInt64(&h.active))
+		ndtm.CloseWithCode(conn, spec.CloseServerOverloaded, spec.ReasonServerOverloaded)
+		return
+	}
+
+	// Make sure the connection is closed after (at most) MaxRuntime, letting
+	// the client know why. The timer is restarted once the measurement
+	// starts: until then, it bounds the setup below.
+	ctx, cancel := context.WithCancel(req.Context())
 	defer cancel()
+	timer := time.AfterFunc(spec.MaxRuntime+spec.RuntimeGrace, func() {
+		ndtm.CloseWithCode(conn, spec.CloseDurationExceeded, spec.ReasonDurationExceeded)
+	})
+	defer timer.Stop()
 	go func() {
 		<-ctx.Done()
 		conn.Close()
 	}()
 
-	// Set congestion control algorithm for this connection.
-	fp, err := netx.GetFile(conn.UnderlyingConn())
-	if err != nil {
-		zap.L().Sugar().Error("Cannot get the connection's fp: %s", err)
+	if ccErr != nil && requestedCC != "" {
+		zap.L().Sugar().Errorf("Cannot enable any of the requested cc %s: %v", strings.Join(candidates, ","), ccErr)
+		ndtm.CloseWithCode(conn, spec.CloseUnsupportedCC, spec.ReasonUnsupportedCC)
+		return
 	}
-	err = congestion.Set(fp, requestCC)
-	if err != nil {
-		zap.L().Sugar().Errorf("Cannot enable cc %s: %v", requestCC, err)
-		// In case of failure, we still want to continue the measurement with
-		// the current cc as long as we know what it is -- see below.
+	if ccErr != nil {
+		zap.L().Sugar().Errorf("Cannot enable cc %s: %v", strings.Join(candidates, ","), ccErr)
+		// The client did not ask for this algorithm, so we can continue the
+		// measurement with the current cc as long as we know what it is --
+		// see below.
 	}
 
 	// Get the cc algorithm from the socket. This makes sure we set it
 	// correctly in the result struct. A failure here prevents the measurement
 	// from starting.
-	connInfo, err := getConnInfo(conn)
+	// Upgrade does not enable any WebSocket extension, so there are none to
+	// record in connInfo.
+	connInfo, err := ndtm.GetConnInfo(conn, true)
 	if err != nil {
 		zap.L().Sugar().Error("Cannot get connection info: ", err)
+		ndtm.CloseWithCode(conn, spec.CloseInternalError, spec.ReasonInternalError)
+		return
 	}
 	zap.L().Sugar().Debug("cc: ", connInfo.CC)
 
@@ -118,26 +263,65 @@ func (h *Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter,
 	if err != nil {
 		// TODO: increase a prometheus counter.
 		zap.L().Sugar().Warn("Cannot create result", err)
+		ndtm.CloseWithCode(conn, spec.CloseInternalError, spec.ReasonInternalError)
 		return
 	}
 	// TODO: increase a prometheus counter here.
+	data.SubTest = string(kind)
+	data.CongestionControl = connInfo.CC
+	data.RequestedCongestionControl = requestedCC
+	data.MeasurementID = mid
+	if req.TLS != nil {
+		data.TLS = results.NewTLSInfo(req.TLS)
+	}
+	data.Identity = getIdentityFromRequest(req)
+
+	// Estimate the clock offset from the client, if requested, before the
+	// measurement starts. A failure leaves the connection unusable, so the
+	// flow is archived without measurements.
+	if clockSync > 0 {
+		data.ClockSync, err = ndtm.RespondClockOffset(conn, clockSync)
+		if err != nil {
+			zap.L().Sugar().Warnw("Cannot estimate clock offset",
+				"client", clientIP(req),
+				"error", err)
+			ndtm.CloseWithCode(conn, spec.CloseInternalError, spec.ReasonInternalError)
+			data.ClockSyncError = err.Error()
+			data.StartTime = time.Now().UTC()
+			data.EndTime = data.StartTime
+			h.writeResult(data.UUID, kind, data)
+			return
+		}
+	}
 
+	// The result is written once the measurement channel has been drained.
+	drained := make(chan struct{})
 	data.StartTime = time.Now().UTC()
+	// The client starts timing the measurement only now, too.
+	timer.Reset(spec.MaxRuntime + spec.RuntimeGrace)
 	defer func() {
+		<-drained
 		data.EndTime = time.Now().UTC()
+		data.ByteDivergence = ndtm.ComputeByteDivergence(data)
+		if d := data.ByteDivergence; d != nil {
+			if d.Buffering {
+				middleboxFlows.WithLabelValues("buffering").Inc()
+			}
+			if d.Proxying {
+				middleboxFlows.WithLabelValues("proxying").Inc()
+			}
+		}
 		h.writeResult(data.UUID, kind, data)
 	}()
-	data.SubTest = string(kind)
-	data.CongestionControl = connInfo.CC
-	data.MeasurementID = mid
 
 	// Run measurement.
-	measurements := make(chan results.Measurement, 64)
+	measurements := ndtm.NewMeasurements(h.delivery)
 
 	// Drain the measurement channel and append the measurement to the correct
 	// field in the result struct according to the origin.
 	go func() {
-		for m := range measurements {
+		defer close(drained)
+		for m := range measurements.C {
 			// The measurement protocol has a sender and a receiver. The
 			// result struct has a server and a client. We need to append the
 			// measurement to the right slice here.
@@ -147,27 +331,98 @@ func (h *Handler) runMeasurement(kind spec.SubtestKind, rw http.ResponseWriter,
 					data.ServerMeasurements = append(data.ServerMeasurements, m)
 				} else {
 					data.ClientMeasurements = append(data.ClientMeasurements, m)
+					ndtm.RecordPeer(m, &data.ClientCongestionControl, &data.PeerUUID)
 				}
 			case spec.SubtestUpload:
 				if m.Origin == "receiver" {
 					data.ServerMeasurements = append(data.ServerMeasurements, m)
 				} else {
 					data.ClientMeasurements = append(data.ClientMeasurements, m)
+					ndtm.RecordPeer(m, &data.ClientCongestionControl, &data.PeerUUID)
 				}
 			}
 
 			zap.L().Sugar().Debugw("Measurement received",
 				"origin", m.Origin)
 		}
+		data.DroppedMeasurements = measurements.Dropped()
+		for origin, n := range data.DroppedMeasurements {
+			droppedMeasurements.WithLabelValues(origin).Add(float64(n))
+		}
+		data.InvalidMeasurements = measurements.Invalid()
+		for reason, n := range data.InvalidMeasurements {
+			invalidMeasurements.WithLabelValues(reason).Add(float64(n))
+		}
 		zap.L().Sugar().Debug("Done receiving from measurement channel")
 	}()
 
 	// Start the sender or the receiver according to the subtest kind.
 	if kind == spec.SubtestDownload {
-		ndtm.Sender(ctx, conn, connInfo, measurements)
+		ndtm.Sender(ctx, conn, connInfo, enc, measurements)
 	} else {
-		ndtm.Receiver(ctx, conn, connInfo, measurements)
+		ndtm.Receiver(ctx, conn, connInfo, enc, measurements)
+	}
+}
+
+// selectCC returns the congestion control algorithms to try for a request.
+// requested is a comma-separated list of algorithms in order of preference,
+// the ones allowed on this server are returned in the same order. If the
+// client did not request any algorithm, defaultCC is returned if allowed, or
+// nothing to keep the system's default.
+func (h *Handler) selectCC(requested string) ([]string, error) {
+	if requested == "" {
+		if h.allowedCC == nil || flagx.StringArray(h.allowedCC).Contains(defaultCC) {
+			return []string{defaultCC}, nil
+		}
+		return nil, nil
+	}
+	var candidates []string
+	for _, cc := range strings.Split(requested, ",") {
+		cc = strings.TrimSpace(cc)
+		if cc == "" {
+			continue
+		}
+		if h.allowedCC == nil || flagx.StringArray(h.allowedCC).Contains(cc) {
+			candidates = append(candidates, cc)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, ErrUnsupportedCC
+	}
+	return candidates, nil
+}
+
+// setCC sets the first of candidates that can be enabled on the socket
+// carrying req. If none can, it returns the ones that failed and the last
+// error.
+func setCC(req *http.Request, candidates []string) ([]string, error) {
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	rc, err := rawConnFromRequest(req)
+	if err != nil {
+		return candidates, err
+	}
+	var failed []string
+	for _, cc := range candidates {
+		if err = congestion.Set(rc, cc); err == nil {
+			return nil, nil
+		}
+		zap.L().Sugar().Infof("Cannot enable cc %s: %v", cc, err)
+		failed = append(failed, cc)
 	}
+	return failed, err
+}
+
+// without returns the elements of list not in remove.
+func without(list, remove []string) []string {
+	var res []string
+	for _, v := range list {
+		if !flagx.StringArray(remove).Contains(v) {
+			res = append(res, v)
+		}
+	}
+	return res
 }
 
 func createResult(connUUID string) (*results.NDTMResult, error) {
@@ -178,8 +433,8 @@ func createResult(connUUID string) (*results.NDTMResult, error) {
 	}, nil
 }
 
-func (h Handler) writeResult(uuid string, kind spec.SubtestKind, result *results.NDTMResult) {
-	fp, err := persistence.New(h.dataDir, string(kind), uuid)
+func (h *Handler) writeResult(uuid string, kind spec.SubtestKind, result *results.NDTMResult) {
+	fp, err := persistence.New(h.dataDir, string(kind), uuid, h.format)
 	if err != nil {
 		zap.L().Sugar().Error("results.NewFile failed", err)
 		return
@@ -190,27 +445,75 @@ func (h Handler) writeResult(uuid string, kind spec.SubtestKind, result *results
 	warnonerror.Close(fp, string(kind)+": ignoring fp.Close error")
 }
 
-// Return a ConnectionInfo struct for the given websocket connection.
-func getConnInfo(conn *websocket.Conn) (*results.ConnectionInfo, error) {
-	fp, err := netx.GetFile(conn.UnderlyingConn())
+// rawConnFromRequest returns the socket of the TCP flow carrying req.
+func rawConnFromRequest(req *http.Request) (syscall.RawConn, error) {
+	conn := netx.ConnFromContext(req.Context())
+	if conn == nil {
+		return nil, errors.New("connection not found in the request context")
+	}
+	return netx.GetRawConn(conn)
+}
+
+// getUUIDFromRequest returns the UUID of the TCP flow carrying req.
+func getUUIDFromRequest(req *http.Request) (string, error) {
+	rc, err := rawConnFromRequest(req)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	cc, err := congestion.Get(fp)
+	return netx.GetUUID(rc)
+}
+
+// clientIP returns the IP address of the client sending req.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
-		return nil, err
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// getIdentityFromRequest returns the identity the client authenticated with,
+// either via the auth package or via a JWT access token, if any.
+func getIdentityFromRequest(req *http.Request) *results.Identity {
+	if id := auth.FromContext(req.Context()); id != nil {
+		return id
 	}
-	// Get UUID for this TCP flow.
-	uuid, err := uuid.FromFile(fp)
+	if claims := controller.GetClaim(req.Context()); claims != nil {
+		return &results.Identity{
+			Method:  "token",
+			Subject: claims.Subject,
+		}
+	}
+	return nil
+}
+
+// getClockSyncFromRequest returns the number of clock offset estimation
+// exchanges requested by the client, or zero.
+func getClockSyncFromRequest(req *http.Request) (int, error) {
+	s := req.URL.Query().Get(spec.ClockSyncParam)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-	return &results.ConnectionInfo{
-		UUID:   uuid,
-		Client: conn.RemoteAddr().String(),
-		Server: conn.RemoteAddr().String(),
-		CC:     cc,
-	}, nil
+	if n < 0 || n > spec.MaxClockSyncSamples {
+		return 0, fmt.Errorf("%s must be between 0 and %d", spec.ClockSyncParam,
+			spec.MaxClockSyncSamples)
+	}
+	return n, nil
+}
+
+// getEncodingFromRequest returns the encoding of measurement messages
+// requested by the client, or ndtm.EncodingJSON if none or an unsupported one
+// was requested.
+func getEncodingFromRequest(req *http.Request) ndtm.Encoding {
+	enc, err := ndtm.ParseEncoding(req.URL.Query().Get(spec.EncodingParam))
+	if err != nil {
+		return ndtm.EncodingJSON
+	}
+	return enc
 }
 
 // getMIDFromRequest extracts the measurement id ("mid") from a given HTTP
@@ -1,19 +1,73 @@
+// Package netx provides access to the socket underlying a net.Conn without
+// duplicating its file descriptor.
 package netx
 
 import (
-	"crypto/tls"
+	"context"
+	"errors"
 	"fmt"
 	"net"
-	"os"
+	"syscall"
+
+	"github.com/m-lab/uuid"
 )
 
-func GetFile(conn net.Conn) (*os.File, error) {
-	switch t := conn.(type) {
-	case *net.TCPConn:
-		return t.File()
-	case *tls.Conn:
-		return t.NetConn().(*net.TCPConn).File()
-	default:
-		return nil, fmt.Errorf("unsupported connection type: %T", t)
+// ErrNoSupport is returned on systems that do not support the requested
+// socket operation.
+var ErrNoSupport = errors.New("operation not supported")
+
+// NetConner is implemented by connections wrapping another net.Conn, such as
+// *tls.Conn. GetRawConn uses it to reach the underlying socket.
+type NetConner interface {
+	NetConn() net.Conn
+}
+
+// GetRawConn returns a syscall.RawConn for the socket underlying conn.
+//
+// Unlike (*net.TCPConn).File(), this does not duplicate the file descriptor,
+// so there is nothing to close: the returned RawConn is valid for as long as
+// conn is open. Connections wrapping another net.Conn are supported as long
+// as they implement NetConner.
+func GetRawConn(conn net.Conn) (syscall.RawConn, error) {
+	for {
+		switch t := conn.(type) {
+		case syscall.Conn:
+			return t.SyscallConn()
+		case NetConner:
+			conn = t.NetConn()
+		default:
+			return nil, fmt.Errorf("unsupported connection type: %T", t)
+		}
+	}
+}
+
+type connKey struct{}
+
+// WithConn returns a copy of ctx carrying conn. It can be used as
+// http.Server's ConnContext, so that handlers can reach the socket of a
+// request with ConnFromContext.
+func WithConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// ConnFromContext returns the connection stored in ctx by WithConn, or nil.
+func ConnFromContext(ctx context.Context) net.Conn {
+	conn, _ := ctx.Value(connKey{}).(net.Conn)
+	return conn
+}
+
+// GetUUID returns the globally unique identifier of the socket referenced by
+// rc, as computed by github.com/m-lab/uuid.
+func GetUUID(rc syscall.RawConn) (string, error) {
+	cookie, err := getCookie(rc)
+	if err != nil {
+		return "", err
 	}
+	return uuid.FromCookie(cookie), nil
+}
+
+// OpenFiles returns the number of file descriptors currently open by this
+// process. It is meant to detect descriptor leaks.
+func OpenFiles() (int, error) {
+	return openFiles()
 }
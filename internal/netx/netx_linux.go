@@ -0,0 +1,37 @@
+package netx
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func getCookie(rc syscall.RawConn) (uint64, error) {
+	var (
+		cookie     uint64
+		syscallErr error
+	)
+	err := rc.Control(func(fd uintptr) {
+		cookie, syscallErr = unix.GetsockoptUint64(int(fd), unix.SOL_SOCKET, unix.SO_COOKIE)
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Kernels older than 4.12 do not support reading SO_COOKIE.
+	if syscallErr == unix.ENOPROTOOPT {
+		return 0, ErrNoSupport
+	}
+	if syscallErr != nil {
+		return 0, syscallErr
+	}
+	return cookie, nil
+}
+
+func openFiles() (int, error) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, err
+	}
+	return len(fds), nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package netx
+
+import (
+	"syscall"
+)
+
+// getCookie fails on systems without SO_COOKIE. Emulating it with a counter
+// would give the same socket a different UUID at every call.
+func getCookie(syscall.RawConn) (uint64, error) {
+	return 0, ErrNoSupport
+}
+
+func openFiles() (int, error) {
+	return 0, ErrNoSupport
+}
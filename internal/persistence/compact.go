@@ -0,0 +1,377 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+// CompactFormat identifies archives in the compact format.
+const CompactFormat = "ndtm-compact/1"
+
+// Kinds of Column.
+const (
+	// ColumnInt columns contain integers, delta-encoded.
+	ColumnInt = "int"
+	// ColumnTime columns contain UTC timestamps, delta-encoded as
+	// nanoseconds since the epoch.
+	ColumnTime = "time"
+	// ColumnDict columns contain any JSON value, dictionary-encoded.
+	ColumnDict = "dict"
+)
+
+// ErrNotCompact is returned when decoding an archive that is not in the
+// compact format.
+var ErrNotCompact = errors.New("not a compact archive")
+
+// CompactResult is the compact archive format of a results.NDTMResult. It
+// is a JSON document with the same fields as NDTMResult, except for the
+// measurements, which are stored as columnar Series.
+type CompactResult struct {
+	// Format is always CompactFormat.
+	Format string
+	results.NDTMResult
+	// ServerMeasurements and ClientMeasurements are nil if the
+	// corresponding NDTMResult fields are nil.
+	ServerMeasurements *Series
+	ClientMeasurements *Series
+}
+
+// Series is a list of measurements stored column by column. Each column
+// contains a field of the measurements, identified by its path (e.g.
+// "TCPInfo.RTT"). The ConnectionInfo of the measurements is stored as a
+// single field, so each distinct ConnectionInfo is stored once.
+type Series struct {
+	// Len is the number of measurements.
+	Len     int
+	Columns []*Column
+}
+
+// Column contains the values of a field in a Series.
+type Column struct {
+	// Name is the path of the field.
+	Name string
+	// Kind is ColumnInt, ColumnTime or ColumnDict.
+	Kind string
+	// Missing lists, in increasing order, the measurements without this
+	// field. The other fields only contain values for the measurements
+	// having it.
+	Missing []int `json:",omitempty"`
+	// Deltas contains the values of ColumnInt and ColumnTime columns: the
+	// first value, then the difference between each value and the previous
+	// one.
+	Deltas []int64 `json:",omitempty"`
+	// Dict and Index contain the values of ColumnDict columns: the value of
+	// the i-th measurement having this field is Dict[Index[i]].
+	Dict  []json.RawMessage `json:",omitempty"`
+	Index []int             `json:",omitempty"`
+}
+
+// connectionInfoField is stored as a whole rather than flattened.
+const connectionInfoField = "ConnectionInfo"
+
+// ToCompact converts r to the compact format.
+func ToCompact(r *results.NDTMResult) (*CompactResult, error) {
+	c := &CompactResult{
+		Format:     CompactFormat,
+		NDTMResult: *r,
+	}
+	c.NDTMResult.ServerMeasurements = nil
+	c.NDTMResult.ClientMeasurements = nil
+	var err error
+	if c.ServerMeasurements, err = newSeries(r.ServerMeasurements); err != nil {
+		return nil, err
+	}
+	if c.ClientMeasurements, err = newSeries(r.ClientMeasurements); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// FromCompact converts c back to a results.NDTMResult.
+func FromCompact(c *CompactResult) (*results.NDTMResult, error) {
+	if c.Format != CompactFormat {
+		return nil, fmt.Errorf("%w: format %q", ErrNotCompact, c.Format)
+	}
+	r := c.NDTMResult
+	var err error
+	if r.ServerMeasurements, err = c.ServerMeasurements.measurements(); err != nil {
+		return nil, fmt.Errorf("ServerMeasurements: %w", err)
+	}
+	if r.ClientMeasurements, err = c.ClientMeasurements.measurements(); err != nil {
+		return nil, fmt.Errorf("ClientMeasurements: %w", err)
+	}
+	return &r, nil
+}
+
+// Decode decodes an archived result, either in the compact format or as a
+// JSON results.NDTMResult.
+func Decode(data []byte) (*results.NDTMResult, error) {
+	var probe struct{ Format string }
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, err
+	}
+	if probe.Format == "" {
+		var r results.NDTMResult
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, err
+		}
+		return &r, nil
+	}
+	var c CompactResult
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return FromCompact(&c)
+}
+
+// newSeries builds the Series of measurements, or nil if measurements is nil.
+func newSeries(measurements []results.Measurement) (*Series, error) {
+	if measurements == nil {
+		return nil, nil
+	}
+	s := &Series{Len: len(measurements)}
+	// values maps each field's path to its value in each measurement.
+	values := map[string][]json.RawMessage{}
+	for i, m := range measurements {
+		fields, err := flatten(m)
+		if err != nil {
+			return nil, err
+		}
+		for name, v := range fields {
+			if values[name] == nil {
+				values[name] = make([]json.RawMessage, len(measurements))
+			}
+			values[name][i] = v
+		}
+	}
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s.Columns = append(s.Columns, newColumn(name, values[name]))
+	}
+	return s, nil
+}
+
+// measurements returns the measurements in s, or nil if s is nil.
+func (s *Series) measurements() ([]results.Measurement, error) {
+	if s == nil {
+		return nil, nil
+	}
+	fields := make([]map[string]interface{}, s.Len)
+	for i := range fields {
+		fields[i] = map[string]interface{}{}
+	}
+	for _, c := range s.Columns {
+		values, err := c.values(s.Len)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", c.Name, err)
+		}
+		for i, v := range values {
+			if v != nil {
+				set(fields[i], strings.Split(c.Name, "."), v)
+			}
+		}
+	}
+	measurements := make([]results.Measurement, s.Len)
+	for i := range measurements {
+		data, err := json.Marshal(fields[i])
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &measurements[i]); err != nil {
+			return nil, err
+		}
+	}
+	return measurements, nil
+}
+
+// flatten returns the JSON value of each field of m, by path. Objects are
+// flattened, except for ConnectionInfo and empty objects.
+func flatten(m results.Measurement) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	var walk func(prefix string, obj map[string]json.RawMessage)
+	walk = func(prefix string, obj map[string]json.RawMessage) {
+		for k, v := range obj {
+			name := prefix + k
+			var child map[string]json.RawMessage
+			if name != connectionInfoField && bytes.HasPrefix(v, []byte("{")) &&
+				json.Unmarshal(v, &child) == nil && len(child) > 0 {
+				walk(name+".", child)
+				continue
+			}
+			fields[name] = v
+		}
+	}
+	walk("", obj)
+	return fields, nil
+}
+
+// set sets the field at path in obj to v, creating the intermediate objects.
+func set(obj map[string]interface{}, path []string, v json.RawMessage) {
+	for _, k := range path[:len(path)-1] {
+		child, ok := obj[k].(map[string]interface{})
+		if !ok {
+			child = map[string]interface{}{}
+			obj[k] = child
+		}
+		obj = child
+	}
+	obj[path[len(path)-1]] = v
+}
+
+// newColumn builds a column from the values of a field, nil for the
+// measurements without it, choosing the most compact kind that can
+// represent them exactly.
+func newColumn(name string, values []json.RawMessage) *Column {
+	c := &Column{Name: name}
+	var present []json.RawMessage
+	for i, v := range values {
+		if v == nil {
+			c.Missing = append(c.Missing, i)
+			continue
+		}
+		present = append(present, v)
+	}
+	if ints, ok := parseInts(present); ok {
+		c.Kind = ColumnInt
+		c.Deltas = deltaEncode(ints)
+		return c
+	}
+	if times, ok := parseTimes(present); ok {
+		c.Kind = ColumnTime
+		c.Deltas = deltaEncode(times)
+		return c
+	}
+	c.Kind = ColumnDict
+	index := map[string]int{}
+	for _, v := range present {
+		i, ok := index[string(v)]
+		if !ok {
+			i = len(c.Dict)
+			index[string(v)] = i
+			c.Dict = append(c.Dict, v)
+		}
+		c.Index = append(c.Index, i)
+	}
+	return c
+}
+
+// values returns the JSON value of the field for each of the n measurements
+// of the series, nil for the measurements without it.
+func (c *Column) values(n int) ([]json.RawMessage, error) {
+	var present []json.RawMessage
+	switch c.Kind {
+	case ColumnInt:
+		for _, v := range deltaDecode(c.Deltas) {
+			present = append(present, json.RawMessage(strconv.FormatInt(v, 10)))
+		}
+	case ColumnTime:
+		for _, v := range deltaDecode(c.Deltas) {
+			data, err := json.Marshal(time.Unix(0, v).UTC())
+			if err != nil {
+				return nil, err
+			}
+			present = append(present, data)
+		}
+	case ColumnDict:
+		for _, i := range c.Index {
+			if i < 0 || i >= len(c.Dict) {
+				return nil, fmt.Errorf("index %d out of range", i)
+			}
+			present = append(present, c.Dict[i])
+		}
+	default:
+		return nil, fmt.Errorf("unknown kind %q", c.Kind)
+	}
+	if len(present)+len(c.Missing) != n {
+		return nil, fmt.Errorf("%d values and %d missing for %d measurements",
+			len(present), len(c.Missing), n)
+	}
+	values := make([]json.RawMessage, n)
+	missing := c.Missing
+	for i := range values {
+		if len(missing) > 0 && missing[0] == i {
+			missing = missing[1:]
+			continue
+		}
+		values[i], present = present[0], present[1:]
+	}
+	if len(missing) > 0 {
+		return nil, errors.New("missing indexes out of range or not sorted")
+	}
+	return values, nil
+}
+
+// parseInts parses values as int64s, if they all are integers whose JSON
+// representation can be reproduced exactly.
+func parseInts(values []json.RawMessage) ([]int64, bool) {
+	ints := make([]int64, len(values))
+	for i, v := range values {
+		n, err := strconv.ParseInt(string(v), 10, 64)
+		if err != nil || strconv.FormatInt(n, 10) != string(v) {
+			return nil, false
+		}
+		ints[i] = n
+	}
+	return ints, true
+}
+
+// parseTimes parses values as timestamps in nanoseconds since the epoch, if
+// they all are UTC timestamps whose JSON representation can be reproduced
+// exactly.
+func parseTimes(values []json.RawMessage) ([]int64, bool) {
+	times := make([]int64, len(values))
+	for i, v := range values {
+		var t time.Time
+		if !bytes.HasPrefix(v, []byte(`"`)) || json.Unmarshal(v, &t) != nil {
+			return nil, false
+		}
+		// Timestamps outside the range of UnixNano cannot be reproduced.
+		ns := t.UnixNano()
+		data, err := json.Marshal(time.Unix(0, ns).UTC())
+		if err != nil || !bytes.Equal(data, v) {
+			return nil, false
+		}
+		times[i] = ns
+	}
+	return times, true
+}
+
+func deltaEncode(values []int64) []int64 {
+	deltas := make([]int64, len(values))
+	var prev int64
+	for i, v := range values {
+		deltas[i] = v - prev
+		prev = v
+	}
+	return deltas
+}
+
+func deltaDecode(deltas []int64) []int64 {
+	values := make([]int64, len(deltas))
+	var prev int64
+	for i, d := range deltas {
+		prev += d
+		values[i] = prev
+	}
+	return values
+}
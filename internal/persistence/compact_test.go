@@ -0,0 +1,148 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/inetdiag"
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+func newTestResult() *results.NDTMResult {
+	cest := time.FixedZone("CEST", 2*60*60)
+	start := time.Date(2023, 5, 4, 10, 0, 0, 123456789, time.UTC)
+	connInfo := &results.ConnectionInfo{
+		Client: "192.0.2.1:54321",
+		Server: "192.0.2.2:443",
+		UUID:   "host_1683194400_0000000000000001",
+		CC:     "bbr",
+		Family: "ipv4",
+	}
+	return &results.NDTMResult{
+		GitShortCommit: "abcdef0",
+		Version:        "0",
+		MeasurementID:  "7c4a1f2e",
+		UUID:           "host_1683194400_0000000000000001",
+		StartTime:      start,
+		EndTime:        start.Add(10 * time.Second).In(cest),
+		SubTest:        "download",
+		ServerMeasurements: []results.Measurement{
+			{
+				Timestamp:      start.Add(time.Second),
+				AppInfo:        &results.AppInfo{NumBytes: 1 << 20, ElapsedTime: 1000000},
+				ConnectionInfo: connInfo,
+				BBRInfo: &results.BBRInfo{
+					BBRInfo:     inetdiag.BBRInfo{BW: 12345678, MinRTT: 1500, PacingGain: 256, CwndGain: 512},
+					ElapsedTime: 1000000,
+				},
+				CCInfo: &results.CCInfo{
+					Algorithm:   "bbr",
+					BBR:         &inetdiag.BBRInfo{BW: 12345678, MinRTT: 1500},
+					ElapsedTime: 1000000,
+				},
+				TCPInfo: &results.TCPInfo{
+					LinuxTCPInfo: tcp.LinuxTCPInfo{State: 1, RTT: 2000, BytesAcked: 1 << 20},
+					ElapsedTime:  1000000,
+				},
+				Origin: "sender",
+			},
+			{
+				// A timestamp that is not in UTC, in a column of UTC ones.
+				Timestamp:      start.Add(2 * time.Second).In(cest),
+				AppInfo:        &results.AppInfo{NumBytes: 3 << 20, ElapsedTime: 2000000},
+				ConnectionInfo: connInfo,
+				CCInfo: &results.CCInfo{
+					Algorithm:   "cubic",
+					ElapsedTime: 2000000,
+				},
+				Origin:      "sender",
+				Unavailable: []string{results.UnavailableTCPInfo},
+			},
+			{
+				// No sub-structs at all.
+				Origin: "sender",
+			},
+		},
+		ClientMeasurements: []results.Measurement{
+			{
+				Timestamp: start.Add(time.Second).In(cest),
+				AppInfo:   &results.AppInfo{NumBytes: 1 << 19, ElapsedTime: 1000000},
+				Origin:    "receiver",
+			},
+			{
+				Timestamp: start.Add(2 * time.Second).In(cest),
+				AppInfo:   &results.AppInfo{NumBytes: 3 << 19, ElapsedTime: 2000000},
+				Origin:    "receiver",
+			},
+		},
+	}
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		result *results.NDTMResult
+	}{
+		{
+			name:   "full",
+			result: newTestResult(),
+		},
+		{
+			name: "no-measurements",
+			result: func() *results.NDTMResult {
+				r := newTestResult()
+				r.ServerMeasurements = nil
+				r.ClientMeasurements = []results.Measurement{}
+				return r
+			}(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := json.Marshal(tt.result)
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			c, err := ToCompact(tt.result)
+			if err != nil {
+				t.Fatalf("ToCompact() error = %v", err)
+			}
+			data, err := json.Marshal(c)
+			if err != nil {
+				t.Fatalf("json.Marshal(compact) error = %v", err)
+			}
+			r, err := Decode(data)
+			if err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			got, err := json.Marshal(r)
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("round trip mismatch:\ngot  %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	want, err := json.Marshal(newTestResult())
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	r, err := Decode(want)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	got, err := json.Marshal(r)
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Decode() mismatch:\ngot  %s\nwant %s", got, want)
+	}
+}
@@ -3,20 +3,48 @@ package persistence
 import (
 	"compress/gzip"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
 	"time"
+
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+// Format is the format results are saved in.
+type Format string
+
+const (
+	// FormatJSON saves results as JSON results.NDTMResult documents.
+	FormatJSON Format = "json"
+
+	// FormatCompact saves results as JSON CompactResult documents.
+	FormatCompact Format = "compact"
 )
 
+// ParseFormat parses the name of a Format.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatJSON, FormatCompact:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid archive format %q (must be %s or %s)", s,
+		FormatJSON, FormatCompact)
+}
+
 // DataFile is the file where we save measurements.
 type DataFile struct {
 	writer io.WriteCloser
 	fp     *os.File
+	format Format
 }
 
-func newDataFile(datadir, subtest, uuid string) (*DataFile, error) {
-	timestamp := time.Now()
+func newDataFile(datadir, subtest, uuid string, format Format) (*DataFile, error) {
+	// The directory and the file name use the UTC time, which the "Z" suffix
+	// in the file name refers to.
+	timestamp := time.Now().UTC()
 	dir := path.Join(datadir, "ndtm", timestamp.Format("2006/01/02"))
 	err := os.MkdirAll(dir, 0755)
 	if err != nil {
@@ -36,12 +64,13 @@ func newDataFile(datadir, subtest, uuid string) (*DataFile, error) {
 	return &DataFile{
 		writer: writer,
 		fp:     fp,
+		format: format,
 	}, nil
 }
 
-// New creates a DataFile for saving results in datadir.
-func New(datadir, subtest, uuid string) (*DataFile, error) {
-	file, err := newDataFile(datadir, subtest, uuid)
+// New creates a DataFile for saving results in datadir in the given format.
+func New(datadir, subtest, uuid string, format Format) (*DataFile, error) {
+	file, err := newDataFile(datadir, subtest, uuid, format)
 	if err != nil {
 		return nil, err
 	}
@@ -49,8 +78,20 @@ func New(datadir, subtest, uuid string) (*DataFile, error) {
 
 }
 
-// Write writes a JSON representation of result to this file.
+// Write writes a JSON representation of result to this file. In the compact
+// format, result must be a *results.NDTMResult.
 func (df *DataFile) Write(result interface{}) error {
+	if df.format == FormatCompact {
+		r, ok := result.(*results.NDTMResult)
+		if !ok {
+			return errors.New("only NDTMResults can be saved in the compact format")
+		}
+		c, err := ToCompact(r)
+		if err != nil {
+			return err
+		}
+		result = c
+	}
 	data, err := json.Marshal(result)
 	if err != nil {
 		return err
@@ -3,7 +3,7 @@ package tcpinfox
 
 import (
 	"errors"
-	"os"
+	"syscall"
 
 	"github.com/m-lab/tcp-info/tcp"
 )
@@ -11,8 +11,8 @@ import (
 // ErrNoSupport is returned on systems that do not support TCP_INFO.
 var ErrNoSupport = errors.New("TCP_INFO not supported")
 
-// GetTCPInfo measures TCP_INFO metrics using |fp| and returns them. In
+// GetTCPInfo measures TCP_INFO metrics using |rc| and returns them. In
 // case of error, instead, an error is returned.
-func GetTCPInfo(fp *os.File) (*tcp.LinuxTCPInfo, error) {
-	return getTCPInfo(fp)
+func GetTCPInfo(rc syscall.RawConn) (*tcp.LinuxTCPInfo, error) {
+	return getTCPInfo(rc)
 }
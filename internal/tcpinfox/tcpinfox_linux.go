@@ -1,22 +1,17 @@
 package tcpinfox
 
 import (
-	"os"
 	"syscall"
 	"unsafe"
 
 	"github.com/m-lab/tcp-info/tcp"
 )
 
-func getTCPInfo(fp *os.File) (*tcp.LinuxTCPInfo, error) {
+func getTCPInfo(rc syscall.RawConn) (*tcp.LinuxTCPInfo, error) {
 	tcpInfo := tcp.LinuxTCPInfo{}
 	tcpInfoLen := uint32(unsafe.Sizeof(tcpInfo))
-	rawConn, err := fp.SyscallConn()
-	if err != nil {
-		return &tcpInfo, err
-	}
 	var syscallErr syscall.Errno
-	err = rawConn.Control(func(fd uintptr) {
+	err := rc.Control(func(fd uintptr) {
 		_, _, syscallErr = syscall.Syscall6(
 			uintptr(syscall.SYS_GETSOCKOPT),
 			fd,
@@ -4,11 +4,11 @@
 package tcpinfox
 
 import (
-	"os"
+	"syscall"
 
 	"github.com/m-lab/tcp-info/tcp"
 )
 
-func getTCPInfo(*os.File) (*tcp.LinuxTCPInfo, error) {
+func getTCPInfo(syscall.RawConn) (*tcp.LinuxTCPInfo, error) {
 	return &tcp.LinuxTCPInfo{}, ErrNoSupport
 }
@@ -0,0 +1,304 @@
+// Package archive reads the results archived by msak-server and msak-client.
+//
+// Results are archived under a data directory as
+// ndtm/YYYY/MM/DD/ndtm-<subtest>-<time>.<uuid>.json.gz, where the date and
+// the time are in UTC, either as JSON results.NDTMResult documents or in the
+// compact format. A Reader iterates over them lazily, only reading the
+// directories and the files that can match its Filter.
+package archive
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robertodauria/msak/internal/persistence"
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+// timeLayout is the layout of the archive time in file names, in UTC.
+const timeLayout = "20060102T150405.000000000Z"
+
+// Filter selects archived results. Zero fields match any result.
+type Filter struct {
+	// From and To select the results archived in [From, To), according to
+	// the time in their file name, or their StartTime if the file name does
+	// not include it.
+	From time.Time
+	To   time.Time
+
+	SubTest       string
+	MeasurementID string
+	UUID          string
+}
+
+// FileError is the error reading or decoding an archived file, e.g. because
+// it is truncated.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Path + ": " + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// Reader iterates over the results archived in a data directory, one day
+// directory at a time in chronological order. Files that cannot be read or
+// decoded, such as those truncated by a crash while being written, are
+// skipped and reported by Skipped. Its zero value is not usable: use
+// NewReader.
+type Reader struct {
+	dir    string
+	filter Filter
+
+	listed bool
+	// days and files are the day directories and the files of the current
+	// one still to be read.
+	days  []string
+	files []string
+
+	path    string
+	result  *results.NDTMResult
+	skipped []*FileError
+	err     error
+}
+
+// NewReader returns a Reader for the results in datadir matching f. Nothing
+// is read until the first call to Next.
+func NewReader(datadir string, f Filter) *Reader {
+	return &Reader{
+		dir:    datadir,
+		filter: f,
+	}
+}
+
+// Next advances to the next matching result, which is then available via
+// Result and Path. It returns false when there are no more results or an
+// error occurs, which is returned by Err.
+func (r *Reader) Next() bool {
+	r.path, r.result = "", nil
+	if r.err != nil {
+		return false
+	}
+	if !r.listed {
+		r.listed = true
+		if r.days, r.err = r.listDays(); r.err != nil {
+			return false
+		}
+	}
+	for {
+		for len(r.files) == 0 {
+			if len(r.days) == 0 {
+				return false
+			}
+			if r.files, r.err = r.listFiles(r.days[0]); r.err != nil {
+				return false
+			}
+			r.days = r.days[1:]
+		}
+		path := r.files[0]
+		r.files = r.files[1:]
+		result, err := ReadFile(path)
+		if err != nil {
+			r.skipped = append(r.skipped, &FileError{Path: path, Err: err})
+			continue
+		}
+		if !r.match(path, result) {
+			continue
+		}
+		r.path, r.result = path, result
+		return true
+	}
+}
+
+// Result returns the current result.
+func (r *Reader) Result() *results.NDTMResult {
+	return r.result
+}
+
+// Path returns the path of the file the current result was read from.
+func (r *Reader) Path() string {
+	return r.path
+}
+
+// Err returns the error that stopped the iteration, if any. Files that could
+// not be read are not errors: see Skipped.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Skipped returns the files skipped so far because they could not be read or
+// decoded.
+func (r *Reader) Skipped() []*FileError {
+	return r.skipped
+}
+
+// ReadAll returns all the results in datadir matching f, and the files
+// skipped.
+func ReadAll(datadir string, f Filter) ([]*results.NDTMResult, []*FileError, error) {
+	r := NewReader(datadir, f)
+	var res []*results.NDTMResult
+	for r.Next() {
+		res = append(res, r.Result())
+	}
+	return res, r.Skipped(), r.Err()
+}
+
+// ReadFile reads an archived result in either format. Files whose name ends
+// with .gz are gunzipped.
+func ReadFile(path string) (*results.NDTMResult, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rd io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		rd = gz
+	}
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	return persistence.Decode(data)
+}
+
+// listDays returns the day directories that can contain matching results,
+// in chronological order.
+func (r *Reader) listDays() ([]string, error) {
+	root := filepath.Join(r.dir, "ndtm")
+	var days []string
+	years, err := listNumbered(root, 4)
+	if err != nil {
+		return nil, err
+	}
+	for _, y := range years {
+		months, err := listNumbered(filepath.Join(root, y), 2)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range months {
+			dd, err := listNumbered(filepath.Join(root, y, m), 2)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range dd {
+				day, err := time.Parse("2006/01/02", y+"/"+m+"/"+d)
+				if err != nil || !r.mayContain(day) {
+					continue
+				}
+				days = append(days, filepath.Join(root, y, m, d))
+			}
+		}
+	}
+	return days, nil
+}
+
+// mayContain returns whether the directory for day, a UTC date, may contain
+// results archived in the filter's time range.
+func (r *Reader) mayContain(day time.Time) bool {
+	if !r.filter.From.IsZero() && !day.Add(24*time.Hour).After(r.filter.From) {
+		return false
+	}
+	if !r.filter.To.IsZero() && !day.Before(r.filter.To) {
+		return false
+	}
+	return true
+}
+
+// listFiles returns the archive files in dir whose name can match the filter.
+func (r *Reader) listFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !(strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".json.gz")) {
+			continue
+		}
+		if subtest, t, uuid, ok := parseName(name); ok {
+			if (r.filter.SubTest != "" && subtest != r.filter.SubTest) ||
+				(r.filter.UUID != "" && uuid != r.filter.UUID) || !r.inRange(t) {
+				continue
+			}
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files, nil
+}
+
+// match returns whether result, read from path, matches the filter.
+func (r *Reader) match(path string, result *results.NDTMResult) bool {
+	f := r.filter
+	if (f.SubTest != "" && result.SubTest != f.SubTest) ||
+		(f.MeasurementID != "" && result.MeasurementID != f.MeasurementID) ||
+		(f.UUID != "" && result.UUID != f.UUID) {
+		return false
+	}
+	if _, _, _, ok := parseName(filepath.Base(path)); !ok {
+		return r.inRange(result.StartTime)
+	}
+	return true
+}
+
+func (r *Reader) inRange(t time.Time) bool {
+	return (r.filter.From.IsZero() || !t.Before(r.filter.From)) &&
+		(r.filter.To.IsZero() || t.Before(r.filter.To))
+}
+
+// parseName parses the subtest, the archive time and the UUID from the name
+// of an archive file.
+func parseName(name string) (subtest string, t time.Time, uuid string, ok bool) {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ".json")
+	if !strings.HasPrefix(name, "ndtm-") {
+		return "", time.Time{}, "", false
+	}
+	rest := name[len("ndtm-"):]
+	i := strings.IndexByte(rest, '-')
+	if i < 0 {
+		return "", time.Time{}, "", false
+	}
+	subtest, rest = rest[:i], rest[i+1:]
+	// UUIDs can contain dots, the archive time has a fixed length.
+	if len(rest) < len(timeLayout)+2 || rest[len(timeLayout)] != '.' {
+		return "", time.Time{}, "", false
+	}
+	t, err := time.Parse(timeLayout, rest[:len(timeLayout)])
+	if err != nil {
+		return "", time.Time{}, "", false
+	}
+	return subtest, t, rest[len(timeLayout)+1:], true
+}
+
+// listNumbered returns the names of the subdirectories of dir made of n
+// digits, sorted.
+func listNumbered(dir string, n int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list %s: %w", dir, err)
+	}
+	var names []string
+	for _, e := range entries {
+		if _, err := strconv.Atoi(e.Name()); e.IsDir() && len(e.Name()) == n && err == nil {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
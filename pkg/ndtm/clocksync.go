@@ -0,0 +1,144 @@
+package ndtm
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+)
+
+// clockSyncTimeout bounds each step of the clock offset estimation.
+const clockSyncTimeout = 5 * time.Second
+
+// ErrNoClockSamples is returned if the clock offset estimation completed no
+// exchange.
+var ErrNoClockSamples = errors.New("no clock samples")
+
+// clockSyncMessage is the message exchanged during the clock offset
+// estimation. The client sends probes with only ClientSend set, the server
+// answers with ServerReceive and ServerSend set too. Finally, the client
+// sends its estimate in Result.
+type clockSyncMessage struct {
+	Sample *results.ClockSample `json:",omitempty"`
+	Result *results.ClockSync   `json:",omitempty"`
+}
+
+// NegotiatedClockSync returns the number of clock offset estimation exchanges
+// confirmed by the server in the upgrade response headers h, or zero if the
+// server does not support the estimation or did not confirm it.
+func NegotiatedClockSync(h http.Header) int {
+	n, err := strconv.Atoi(h.Get(spec.ClockSyncHeader))
+	if err != nil || n < 0 || n > spec.MaxClockSyncSamples {
+		return 0
+	}
+	return n
+}
+
+// EstimateClockOffset estimates the offset between the client's and the
+// server's clocks with n NTP-style exchanges over conn, before the
+// measurement starts. It must be called by the client and matched by a call
+// to RespondClockOffset on the server, which is told n via the
+// spec.ClockSyncParam querystring parameter and confirms it via the
+// spec.ClockSyncHeader response header (see NegotiatedClockSync).
+//
+// The estimate is based on the exchange with the lowest round-trip time, and
+// sent to the server so that both ends can archive it. Since a read timeout
+// makes conn unusable, the measurement cannot continue after an error.
+func EstimateClockOffset(conn *websocket.Conn, n int) (*results.ClockSync, error) {
+	defer conn.SetReadDeadline(time.Time{})
+	defer conn.SetWriteDeadline(time.Time{})
+	cs := &results.ClockSync{}
+	for i := 0; i < n; i++ {
+		conn.SetWriteDeadline(time.Now().Add(clockSyncTimeout))
+		probe := clockSyncMessage{
+			Sample: &results.ClockSample{ClientSend: time.Now().UnixMicro()},
+		}
+		if err := conn.WriteJSON(probe); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(clockSyncTimeout))
+		reply, err := readClockSyncMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now().UnixMicro()
+		if reply.Sample == nil || reply.Sample.ClientSend != probe.Sample.ClientSend {
+			return nil, errors.New("unexpected clock sync reply")
+		}
+		reply.Sample.ClientReceive = now
+		cs.Samples = append(cs.Samples, *reply.Sample)
+	}
+	if len(cs.Samples) == 0 {
+		return nil, ErrNoClockSamples
+	}
+	cs.Offset, cs.RTT = cs.Samples[0].Offset(), cs.Samples[0].RTT()
+	for _, s := range cs.Samples[1:] {
+		if s.RTT() < cs.RTT {
+			cs.Offset, cs.RTT = s.Offset(), s.RTT()
+		}
+	}
+	conn.SetWriteDeadline(time.Now().Add(clockSyncTimeout))
+	if err := conn.WriteJSON(clockSyncMessage{Result: cs}); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// RespondClockOffset answers the n probes sent by EstimateClockOffset on the
+// client and returns the resulting estimate. As for EstimateClockOffset, the
+// measurement cannot continue after an error.
+func RespondClockOffset(conn *websocket.Conn, n int) (*results.ClockSync, error) {
+	defer conn.SetReadDeadline(time.Time{})
+	defer conn.SetWriteDeadline(time.Time{})
+	for i := 0; i < n; i++ {
+		conn.SetReadDeadline(time.Now().Add(clockSyncTimeout))
+		probe, err := readClockSyncMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+		received := time.Now().UnixMicro()
+		if probe.Sample == nil {
+			return nil, errors.New("unexpected clock sync probe")
+		}
+		probe.Sample.ServerReceive = received
+		conn.SetWriteDeadline(time.Now().Add(clockSyncTimeout))
+		probe.Sample.ServerSend = time.Now().UnixMicro()
+		if err := conn.WriteJSON(probe); err != nil {
+			return nil, err
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(clockSyncTimeout))
+	m, err := readClockSyncMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if m.Result == nil {
+		return nil, errors.New("missing clock sync result")
+	}
+	return m.Result, nil
+}
+
+// readClockSyncMessage reads the next text message from conn, discarding any
+// binary message received before it.
+func readClockSyncMessage(conn *websocket.Conn) (*clockSyncMessage, error) {
+	conn.SetReadLimit(spec.MaxScaledMessageSize)
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if kind != websocket.TextMessage {
+			continue
+		}
+		var m clockSyncMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	}
+}
@@ -0,0 +1,97 @@
+package ndtm
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/robertodauria/msak/internal/congestion"
+	"github.com/robertodauria/msak/internal/netx"
+	"github.com/robertodauria/msak/internal/tcpinfox"
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+// GetConnInfo returns the ConnectionInfo for conn. server tells whether conn
+// is the server's endpoint of the connection, i.e. whether its local address
+// is the server's. The congestion control algorithm and the UUID are left
+// empty where the system cannot provide them.
+//
+// The WebSocket extensions are not known to conn, so they are left to the
+// caller to fill in (see Extensions).
+func GetConnInfo(conn *websocket.Conn, server bool) (*results.ConnectionInfo, error) {
+	rc, err := netx.GetRawConn(conn.UnderlyingConn())
+	if err != nil {
+		return nil, err
+	}
+	cc, err := congestion.Get(rc)
+	if err != nil && !errors.Is(err, congestion.ErrNoSupport) {
+		return nil, err
+	}
+	// Get UUID for this TCP flow.
+	uuid, err := netx.GetUUID(rc)
+	if err != nil && !errors.Is(err, netx.ErrNoSupport) {
+		return nil, err
+	}
+	info := &results.ConnectionInfo{
+		UUID:   uuid,
+		Client: conn.RemoteAddr().String(),
+		Server: conn.LocalAddr().String(),
+		CC:     cc,
+		Family: family(conn.LocalAddr()),
+	}
+	if !server {
+		info.Client, info.Server = info.Server, info.Client
+	}
+	// The path MTU is only available where TCP_INFO is supported.
+	if tcpInfo, err := tcpinfox.GetTCPInfo(rc); err == nil {
+		info.PathMTU = tcpInfo.PMTU
+	}
+	if tc, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		info.TLS = results.NewTLSInfo(&state)
+	}
+	return info, nil
+}
+
+// RecordPeer stores the congestion control algorithm and the flow's UUID
+// reported in a peer's measurement into cc and uuid, unless already known.
+func RecordPeer(m results.Measurement, cc, uuid *string) {
+	if m.ConnectionInfo == nil {
+		return
+	}
+	if *cc == "" {
+		*cc = m.ConnectionInfo.CC
+	}
+	if *uuid == "" {
+		*uuid = m.ConnectionInfo.UUID
+	}
+}
+
+// Extensions returns the WebSocket extensions negotiated in an upgrade
+// response with the given headers, including their parameters.
+func Extensions(h http.Header) []string {
+	var res []string
+	for _, v := range h.Values("Sec-WebSocket-Extensions") {
+		for _, ext := range strings.Split(v, ",") {
+			if ext = strings.TrimSpace(ext); ext != "" {
+				res = append(res, ext)
+			}
+		}
+	}
+	return res
+}
+
+// family returns the IP family of addr ("ipv4" or "ipv6").
+func family(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	if tcpAddr.IP.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
+}
@@ -0,0 +1,125 @@
+package ndtm
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+)
+
+// counterflow reads and validates the measurements received from the peer
+// over a flow, so that a misbehaving peer cannot make the results grow
+// without bound or fill them with garbage. Valid measurements are delivered
+// over mchannel, invalid ones are discarded and counted by reason.
+type counterflow struct {
+	// origin is the origin of the peer's measurements.
+	origin   string
+	mchannel *Measurements
+
+	count int
+	// window is the start of the current one-second window and windowCount
+	// the number of messages received in it.
+	window      time.Time
+	windowCount int
+	// last is the AppInfo of the last valid measurement.
+	last *results.AppInfo
+	// connInfo is the last ConnectionInfo received. Peers using a compact
+	// encoding only send it once.
+	connInfo *results.ConnectionInfo
+}
+
+// newCounterflow returns a counterflow for measurements taken by the peer
+// with the given origin ("sender" or "receiver").
+func newCounterflow(origin string, mchannel *Measurements) *counterflow {
+	return &counterflow{
+		origin:   origin,
+		mchannel: mchannel,
+	}
+}
+
+// read reads a measurement message of type kind (JSON text or CBOR binary)
+// from r and delivers it, if valid. It returns the size of the message,
+// which is always read entirely.
+func (cf *counterflow) read(ctx context.Context, kind int, r io.Reader) (int64, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, spec.MaxCounterflowMessageSize+1))
+	size := int64(len(data))
+	if err != nil {
+		return size, err
+	}
+	if size > spec.MaxCounterflowMessageSize {
+		n, err := io.Copy(ioutil.Discard, r)
+		cf.mchannel.reject(results.InvalidTooLarge)
+		return size + n, err
+	}
+	if reason := cf.limit(time.Now()); reason != "" {
+		cf.mchannel.reject(reason)
+		return size, nil
+	}
+	var m results.Measurement
+	if kind == websocket.BinaryMessage {
+		err = cbor.Unmarshal(data, &m)
+	} else {
+		err = json.Unmarshal(data, &m)
+	}
+	if err != nil {
+		cf.mchannel.reject(results.InvalidMalformed)
+		return size, nil
+	}
+	if reason := cf.validate(&m); reason != "" {
+		cf.mchannel.reject(reason)
+		return size, nil
+	}
+	cf.last = m.AppInfo
+	if m.ConnectionInfo != nil {
+		cf.connInfo = m.ConnectionInfo
+	} else {
+		m.ConnectionInfo = cf.connInfo
+	}
+	cf.mchannel.deliver(ctx, m)
+	return size, nil
+}
+
+// limit counts a message received at now and returns the reason for
+// discarding it if the rate or count limits have been exceeded, or an empty
+// string.
+func (cf *counterflow) limit(now time.Time) string {
+	if now.Sub(cf.window) >= time.Second {
+		cf.window = now
+		cf.windowCount = 0
+	}
+	cf.windowCount++
+	if cf.windowCount > spec.MaxCounterflowRate {
+		return results.InvalidRate
+	}
+	cf.count++
+	if cf.count > spec.MaxCounterflowMessages {
+		return results.InvalidCount
+	}
+	return ""
+}
+
+// validate returns the reason why m is not a valid measurement from the peer,
+// or an empty string.
+func (cf *counterflow) validate(m *results.Measurement) string {
+	if m.Origin != cf.origin {
+		return results.InvalidOrigin
+	}
+	app := m.AppInfo
+	if app == nil || app.ElapsedTime <= 0 ||
+		app.ElapsedTime > (spec.MaxRuntime+spec.RuntimeGrace).Microseconds() ||
+		(cf.last != nil && app.ElapsedTime <= cf.last.ElapsedTime) {
+		return results.InvalidElapsedTime
+	}
+	// Compare bits/µs with Mb/s.
+	if app.NumBytes < 0 || (cf.last != nil && app.NumBytes < cf.last.NumBytes) ||
+		float64(app.NumBytes)*8/float64(app.ElapsedTime) > spec.MaxPlausibleRate/1e6 {
+		return results.InvalidNumBytes
+	}
+	return ""
+}
@@ -0,0 +1,153 @@
+package ndtm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+// DeliveryMode decides what Sender and Receiver do with a measurement when
+// the measurement buffer is full.
+type DeliveryMode string
+
+const (
+	// DeliveryDrop discards the measurement, so that reading measurements
+	// slowly never stalls the data path.
+	DeliveryDrop DeliveryMode = "drop"
+
+	// DeliveryBlock waits until there is room in the buffer, or until the
+	// measurement ends.
+	DeliveryBlock DeliveryMode = "block"
+)
+
+// ParseDeliveryMode parses the name of a DeliveryMode.
+func ParseDeliveryMode(s string) (DeliveryMode, error) {
+	switch m := DeliveryMode(s); m {
+	case DeliveryDrop, DeliveryBlock:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid delivery mode %q (must be %s or %s)", s,
+		DeliveryDrop, DeliveryBlock)
+}
+
+// DeliveryPolicy defines how measurements are delivered by Sender and
+// Receiver.
+type DeliveryPolicy struct {
+	// BufferSize is the number of measurements that can be buffered.
+	BufferSize int
+	// Mode is what happens to measurements when the buffer is full.
+	Mode DeliveryMode
+}
+
+// DefaultDeliveryPolicy buffers up to 64 measurements and drops the ones
+// not fitting in the buffer.
+var DefaultDeliveryPolicy = DeliveryPolicy{
+	BufferSize: 64,
+	Mode:       DeliveryDrop,
+}
+
+// Validate checks that p is a valid DeliveryPolicy.
+func (p DeliveryPolicy) Validate() error {
+	if p.BufferSize < 0 {
+		return fmt.Errorf("invalid buffer size %d", p.BufferSize)
+	}
+	_, err := ParseDeliveryMode(string(p.Mode))
+	return err
+}
+
+// Measurements is a buffered channel of measurements, written to by Sender
+// and Receiver according to a DeliveryPolicy. The measurements that could
+// not be delivered are counted by origin, and the invalid ones received from
+// the peer by reason.
+type Measurements struct {
+	// C is the channel measurements are delivered on. It is closed when
+	// the Sender or Receiver writing to it returns.
+	C <-chan results.Measurement
+
+	c    chan results.Measurement
+	mode DeliveryMode
+
+	mu      sync.Mutex
+	dropped map[string]int64
+	invalid map[string]int64
+}
+
+// NewMeasurements returns a Measurements delivering measurements according
+// to p.
+func NewMeasurements(p DeliveryPolicy) *Measurements {
+	c := make(chan results.Measurement, p.BufferSize)
+	return &Measurements{
+		C:    c,
+		c:    c,
+		mode: p.Mode,
+	}
+}
+
+// Dropped returns the number of measurements that could not be delivered so
+// far, by origin, or nil if none was dropped.
+func (ms *Measurements) Dropped() map[string]int64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return copyCounts(ms.dropped)
+}
+
+// Invalid returns the number of measurements received from the peer that
+// were discarded so far, by reason, or nil if none was.
+func (ms *Measurements) Invalid() map[string]int64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return copyCounts(ms.invalid)
+}
+
+// reject counts a measurement received from the peer as invalid.
+func (ms *Measurements) reject(reason string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.invalid == nil {
+		ms.invalid = map[string]int64{}
+	}
+	ms.invalid[reason]++
+}
+
+// deliver sends m over the channel, according to the delivery mode. In
+// block mode, m is dropped if ctx is done before it can be delivered.
+func (ms *Measurements) deliver(ctx context.Context, m results.Measurement) {
+	if ms.mode == DeliveryBlock {
+		select {
+		case ms.c <- m:
+			return
+		case <-ctx.Done():
+		}
+	} else {
+		select {
+		case ms.c <- m:
+			return
+		default:
+		}
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.dropped == nil {
+		ms.dropped = map[string]int64{}
+	}
+	ms.dropped[m.Origin]++
+}
+
+// Close closes C. Sender and Receiver close it when they return, so it
+// must only be called if neither of them is going to be run.
+func (ms *Measurements) Close() {
+	close(ms.c)
+}
+
+func copyCounts(counts map[string]int64) map[string]int64 {
+	if len(counts) == 0 {
+		return nil
+	}
+	c := make(map[string]int64, len(counts))
+	for k, n := range counts {
+		c[k] = n
+	}
+	return c
+}
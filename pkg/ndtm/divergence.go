@@ -0,0 +1,157 @@
+package ndtm
+
+import (
+	"sort"
+
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+const (
+	// bufferingThreshold is the median SentLead above which a flow is
+	// flagged as buffered by a middlebox.
+	bufferingThreshold = 0.5
+
+	// proxyingThreshold is the median AckedLead above which a flow is flagged
+	// as proxied. It leaves room for the receiver's socket buffer and for
+	// errors in aligning the two endpoints' measurements.
+	proxyingThreshold = 0.1
+)
+
+// byteSample is the number of bytes counted by an endpoint at a given time.
+type byteSample struct {
+	t        int64
+	numBytes int64
+	sent     int64
+	acked    int64
+}
+
+// ComputeByteDivergence compares the bytes counted by the sender and by the
+// receiver of the flow in r. Measurements are aligned using their
+// timestamps, moved to the server's clock, if r has a clock offset estimate,
+// or their elapsed time otherwise. It returns nil if none of the receiver's
+// measurements was taken while the sender was measuring.
+func ComputeByteDivergence(r *results.NDTMResult) *results.ByteDivergence {
+	var offset int64
+	useTimestamps := r.ClockSync != nil
+	if useTimestamps {
+		offset = r.ClockSync.Offset
+	}
+	var sender, receiver []byteSample
+	add := func(measurements []results.Measurement, offset int64) {
+		for _, m := range measurements {
+			if m.AppInfo == nil {
+				continue
+			}
+			s := byteSample{
+				t:        m.AppInfo.ElapsedTime,
+				numBytes: m.AppInfo.NumBytes,
+				sent:     -1,
+				acked:    -1,
+			}
+			if useTimestamps {
+				s.t = m.Timestamp.UnixMicro() + offset
+			}
+			switch m.Origin {
+			case "sender":
+				if m.TCPInfo != nil {
+					// BytesSent is zero on kernels not reporting it.
+					if m.TCPInfo.BytesSent > 0 {
+						s.sent = m.TCPInfo.BytesSent - m.TCPInfo.BytesRetrans
+					}
+					s.acked = m.TCPInfo.BytesAcked
+				}
+				sender = append(sender, s)
+			case "receiver":
+				receiver = append(receiver, s)
+			}
+		}
+	}
+	for _, ms := range [][]results.Measurement{r.ClientMeasurements, r.ServerMeasurements} {
+		for _, m := range ms {
+			if m.Timestamp.IsZero() {
+				useTimestamps = false
+			}
+		}
+	}
+	add(r.ClientMeasurements, offset)
+	add(r.ServerMeasurements, 0)
+	sort.Slice(sender, func(i, j int) bool { return sender[i].t < sender[j].t })
+
+	d := &results.ByteDivergence{}
+	var senderLeads, sentLeads, ackedLeads []float64
+	for _, rs := range receiver {
+		ss, ok := interpolate(sender, rs.t)
+		if !ok || ss.numBytes <= 0 || rs.numBytes <= 0 {
+			continue
+		}
+		d.Samples++
+		lead := ss.numBytes - rs.numBytes
+		if lead > d.MaxSenderLead {
+			d.MaxSenderLead = lead
+		}
+		senderLeads = append(senderLeads, float64(lead)/float64(ss.numBytes))
+		if ss.sent > 0 {
+			sentLeads = append(sentLeads,
+				float64(ss.sent-rs.numBytes)/float64(ss.sent))
+		}
+		if ss.acked >= 0 {
+			ackedLeads = append(ackedLeads,
+				float64(ss.acked-rs.numBytes)/float64(rs.numBytes))
+		}
+	}
+	if d.Samples == 0 {
+		return nil
+	}
+	d.SenderLead = median(senderLeads)
+	d.SentLead = median(sentLeads)
+	d.AckedLead = median(ackedLeads)
+	d.Buffering = d.SentLead > bufferingThreshold
+	d.Proxying = d.AckedLead > proxyingThreshold
+	return d
+}
+
+// interpolate returns the sample at time t, linearly interpolated from the
+// given samples sorted by time, if t is within their range. The sent and acked
+// bytes are only interpolated if known for both samples, and -1 otherwise.
+func interpolate(samples []byteSample, t int64) (byteSample, bool) {
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].t >= t })
+	if i == len(samples) {
+		return byteSample{}, false
+	}
+	if samples[i].t == t {
+		return samples[i], true
+	}
+	if i == 0 {
+		return byteSample{}, false
+	}
+	a, b := samples[i-1], samples[i]
+	f := float64(t-a.t) / float64(b.t-a.t)
+	return byteSample{
+		t:        t,
+		numBytes: a.numBytes + int64(f*float64(b.numBytes-a.numBytes)),
+		sent:     interpolateKnown(a.sent, b.sent, f),
+		acked:    interpolateKnown(a.acked, b.acked, f),
+	}, true
+}
+
+// interpolateKnown returns the value at fraction f between a and b, or -1 if
+// either is unknown (negative).
+func interpolateKnown(a, b int64, f float64) int64 {
+	if a < 0 || b < 0 {
+		return -1
+	}
+	return a + int64(f*float64(b-a))
+}
+
+// median returns the median of values, or zero if empty. It sorts values.
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	n := len(values)
+	if n%2 == 1 {
+		return values[n/2]
+	}
+	return (values[n/2-1] + values[n/2]) / 2
+}
@@ -0,0 +1,147 @@
+package ndtm
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/m-lab/tcp-info/tcp"
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+)
+
+// divergenceFlow describes a download flow whose receiver (the client) reads
+// 1 MB/s. The sender's counters are multiples of the receiver's bytes at the
+// same time, so that the expected leads do not depend on the sampling.
+type divergenceFlow struct {
+	written float64
+	sent    float64
+	retrans float64
+	acked   float64
+	tcpInfo bool
+	// If timestamps is set, the client's clock is offset behind the
+	// server's and the client's measurements start late by 1s, so that
+	// their ElapsedTime cannot be used to align them.
+	timestamps bool
+	offset     time.Duration
+}
+
+func (f divergenceFlow) result() *results.NDTMResult {
+	base := time.Date(2023, 5, 4, 10, 0, 0, 0, time.UTC)
+	r := &results.NDTMResult{SubTest: "download"}
+	if f.timestamps {
+		r.ClockSync = &results.ClockSync{Offset: f.offset.Microseconds()}
+	}
+	received := func(e time.Duration) float64 { return 1e6 * e.Seconds() }
+	for e := 100 * time.Millisecond; e <= 5*time.Second; e += 100 * time.Millisecond {
+		m := results.Measurement{
+			Origin: "sender",
+			AppInfo: &results.AppInfo{
+				NumBytes:    int64(f.written * received(e)),
+				ElapsedTime: e.Microseconds(),
+			},
+		}
+		if f.tcpInfo {
+			m.TCPInfo = &results.TCPInfo{LinuxTCPInfo: tcp.LinuxTCPInfo{
+				BytesSent:    int64((f.sent + f.retrans) * received(e)),
+				BytesRetrans: int64(f.retrans * received(e)),
+				BytesAcked:   int64(f.acked * received(e)),
+			}}
+		}
+		if f.timestamps {
+			m.Timestamp = base.Add(e)
+		}
+		r.ServerMeasurements = append(r.ServerMeasurements, m)
+	}
+	// The receiver measures on a different grid than the sender.
+	for e := 250 * time.Millisecond; e < 5*time.Second; e += 250 * time.Millisecond {
+		m := results.Measurement{
+			Origin: "receiver",
+			AppInfo: &results.AppInfo{
+				NumBytes:    int64(received(e)),
+				ElapsedTime: e.Microseconds(),
+			},
+		}
+		if f.timestamps {
+			m.Timestamp = base.Add(e - f.offset)
+			m.AppInfo.ElapsedTime = (e + time.Second).Microseconds()
+		}
+		r.ClientMeasurements = append(r.ClientMeasurements, m)
+	}
+	return r
+}
+
+func TestComputeByteDivergence(t *testing.T) {
+	tests := []struct {
+		name string
+		flow divergenceFlow
+		want results.ByteDivergence
+	}{
+		{
+			// The sender's socket buffer makes the written bytes lead,
+			// but the kernel sent (and retransmitted) only what the
+			// receiver got.
+			name: "no-middlebox",
+			flow: divergenceFlow{written: 3, sent: 1.05, retrans: 2, acked: 1, tcpInfo: true},
+			want: results.ByteDivergence{SenderLead: 2.0 / 3, SentLead: 0.05 / 1.05},
+		},
+		{
+			name: "buffering",
+			flow: divergenceFlow{written: 3, sent: 3, acked: 1, tcpInfo: true},
+			want: results.ByteDivergence{SenderLead: 2.0 / 3, SentLead: 2.0 / 3, Buffering: true},
+		},
+		{
+			name: "proxying",
+			flow: divergenceFlow{written: 1.5, sent: 1.5, acked: 1.5, tcpInfo: true},
+			want: results.ByteDivergence{SenderLead: 1.0 / 3, SentLead: 1.0 / 3, AckedLead: 0.5, Proxying: true},
+		},
+		{
+			name: "no-tcpinfo",
+			flow: divergenceFlow{written: 3},
+			want: results.ByteDivergence{SenderLead: 2.0 / 3},
+		},
+		{
+			name: "clock-offset",
+			flow: divergenceFlow{written: 3, sent: 3, acked: 1, tcpInfo: true,
+				timestamps: true, offset: time.Hour},
+			want: results.ByteDivergence{SenderLead: 2.0 / 3, SentLead: 2.0 / 3, Buffering: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.flow.result()
+			d := ComputeByteDivergence(r)
+			if d == nil {
+				t.Fatal("ComputeByteDivergence() = nil")
+			}
+			if d.Samples != len(r.ClientMeasurements) {
+				t.Errorf("Samples = %d, want %d", d.Samples, len(r.ClientMeasurements))
+			}
+			for _, c := range []struct {
+				name      string
+				got, want float64
+			}{
+				{"SenderLead", d.SenderLead, tt.want.SenderLead},
+				{"SentLead", d.SentLead, tt.want.SentLead},
+				{"AckedLead", d.AckedLead, tt.want.AckedLead},
+			} {
+				if math.Abs(c.got-c.want) > 1e-3 {
+					t.Errorf("%s = %f, want %f", c.name, c.got, c.want)
+				}
+			}
+			if d.Buffering != tt.want.Buffering || d.Proxying != tt.want.Proxying {
+				t.Errorf("Buffering, Proxying = %v, %v, want %v, %v",
+					d.Buffering, d.Proxying, tt.want.Buffering, tt.want.Proxying)
+			}
+		})
+	}
+}
+
+func TestComputeByteDivergenceNoOverlap(t *testing.T) {
+	r := divergenceFlow{written: 1}.result()
+	for i := range r.ClientMeasurements {
+		r.ClientMeasurements[i].AppInfo.ElapsedTime += (time.Minute).Microseconds()
+	}
+	if d := ComputeByteDivergence(r); d != nil {
+		t.Errorf("ComputeByteDivergence() = %+v, want nil", d)
+	}
+}
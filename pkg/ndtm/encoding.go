@@ -0,0 +1,103 @@
+package ndtm
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/websocket"
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+)
+
+// Encoding is the encoding of measurement messages exchanged by the
+// endpoints. It is negotiated when the connection is established: the client
+// requests it via the spec.EncodingParam querystring parameter and the server
+// confirms it in the spec.EncodingHeader response header. Results are always
+// archived as JSON.
+type Encoding string
+
+const (
+	// EncodingJSON sends every measurement as a JSON text message. It is
+	// the default.
+	EncodingJSON Encoding = "json"
+
+	// EncodingCBOR sends the receiver's measurements as CBOR binary
+	// messages. The sender's measurements are still JSON text messages, so
+	// that the receiver can tell them apart from the data. In both
+	// directions, ConnectionInfo is only sent with the first measurement.
+	EncodingCBOR Encoding = "cbor"
+)
+
+// ParseEncoding parses the name of an Encoding.
+func ParseEncoding(s string) (Encoding, error) {
+	switch e := Encoding(s); e {
+	case EncodingJSON, EncodingCBOR:
+		return e, nil
+	}
+	return "", fmt.Errorf("invalid encoding %q (must be %s or %s)", s,
+		EncodingJSON, EncodingCBOR)
+}
+
+// NegotiatedEncoding returns the encoding confirmed by the server in the
+// upgrade response headers h. Servers not supporting the spec.EncodingParam
+// parameter only use EncodingJSON.
+func NegotiatedEncoding(h http.Header) Encoding {
+	enc, err := ParseEncoding(h.Get(spec.EncodingHeader))
+	if err != nil {
+		return EncodingJSON
+	}
+	return enc
+}
+
+var cborEncMode cbor.EncMode
+
+func init() {
+	// Timestamps are encoded as strings to keep their full precision.
+	opts := cbor.EncOptions{Time: cbor.TimeRFC3339Nano}
+	var err error
+	cborEncMode, err = opts.EncMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// measurementWriter writes the measurements taken by one of the endpoints of
+// a flow to the peer.
+type measurementWriter struct {
+	conn *websocket.Conn
+	enc  Encoding
+	// binary is whether measurements are written as CBOR binary messages.
+	binary bool
+	// sentConnInfo is whether a measurement with ConnectionInfo has been
+	// written already.
+	sentConnInfo bool
+}
+
+// newMeasurementWriter returns a measurementWriter for the given origin
+// ("sender" or "receiver").
+func newMeasurementWriter(conn *websocket.Conn, enc Encoding, origin string) *measurementWriter {
+	return &measurementWriter{
+		conn:   conn,
+		enc:    enc,
+		binary: enc == EncodingCBOR && origin == "receiver",
+	}
+}
+
+// write writes m to the peer.
+func (w *measurementWriter) write(m results.Measurement) error {
+	if w.enc != EncodingJSON {
+		if w.sentConnInfo {
+			m.ConnectionInfo = nil
+		}
+		w.sentConnInfo = w.sentConnInfo || m.ConnectionInfo != nil
+	}
+	if !w.binary {
+		return w.conn.WriteJSON(m)
+	}
+	data, err := cborEncMode.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return w.conn.WriteMessage(websocket.BinaryMessage, data)
+}
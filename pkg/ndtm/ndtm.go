@@ -3,25 +3,24 @@ package ndtm
 import (
 	"context"
 	"crypto/rand"
-	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/m-lab/go/memoryless"
 	"github.com/robertodauria/msak/internal/congestion"
 	"github.com/robertodauria/msak/internal/netx"
-	"github.com/robertodauria/msak/internal/tcpinfox"
 	"github.com/robertodauria/msak/pkg/ndtm/results"
 	"github.com/robertodauria/msak/pkg/ndtm/spec"
 	"go.uber.org/zap"
 )
 
-var errNonTextMessage = errors.New("not a text message")
+var errUnexpectedMessage = errors.New("unexpected message type")
 
 func makePreparedMessage(size int) (*websocket.PreparedMessage, error) {
 	data := make([]byte, size)
@@ -32,17 +31,64 @@ func makePreparedMessage(size int) (*websocket.PreparedMessage, error) {
 	return websocket.NewPreparedMessage(websocket.BinaryMessage, data)
 }
 
+// getCCInfo reads the congestion control information exported by the
+// algorithm in use on rc.
+func getCCInfo(rc syscall.RawConn, elapsed int64) (*results.CCInfo, error) {
+	cc, err := congestion.Get(rc)
+	if err != nil {
+		return nil, err
+	}
+	info := &results.CCInfo{
+		Algorithm:   cc,
+		ElapsedTime: elapsed,
+	}
+	// Vegas and DCTCP export structures of the same size, so the algorithm
+	// name is what tells us how to decode TCP_CC_INFO. BBR's variants (e.g.
+	// bbr2) share the same structure.
+	switch {
+	case strings.HasPrefix(cc, "bbr"):
+		bbr, err := congestion.GetBBRInfo(rc)
+		if err != nil {
+			return nil, err
+		}
+		info.BBR = &bbr
+	case cc == "vegas":
+		vegas, err := congestion.GetVegasInfo(rc)
+		if err != nil {
+			return nil, err
+		}
+		info.Vegas = &vegas
+	case cc == "dctcp":
+		dctcp, err := congestion.GetDCTCPInfo(rc)
+		if err != nil {
+			return nil, err
+		}
+		info.DCTCP = &dctcp
+	}
+	return info, nil
+}
+
 // Upgrade upgrades the HTTP connection to WebSockets.
-// Returns the upgraded websocket.Conn.
-func Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+// Returns the upgraded websocket.Conn. Requests from origins not allowed by
+// origins are rejected with 403 Forbidden and ErrOriginNotAllowed. The
+// headers in h, if any, are added to the upgrade response.
+func Upgrade(w http.ResponseWriter, r *http.Request, origins *OriginPolicy,
+	h http.Header) (*websocket.Conn, error) {
 	if r.Header.Get("Sec-WebSocket-Protocol") != spec.SecWebSocketProtocol {
 		w.WriteHeader(http.StatusBadRequest)
 		return nil, errors.New("missing Sec-WebSocket-Protocol header")
 	}
-	h := http.Header{}
-	h.Add("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
+	if !origins.Allowed(r) {
+		w.Header().Set("Connection", "Close")
+		w.WriteHeader(http.StatusForbidden)
+		return nil, ErrOriginNotAllowed
+	}
+	if h == nil {
+		h = http.Header{}
+	}
+	h.Set("Sec-WebSocket-Protocol", spec.SecWebSocketProtocol)
 	u := websocket.Upgrader{
-		// Allow cross-origin resource sharing.
+		// The origin has been checked already.
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
@@ -53,16 +99,29 @@ func Upgrade(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
 	return u.Upgrade(w, r, h)
 }
 
+// CloseWithCode sends a close message with the given code and reason, then
+// closes conn. It is safe to call concurrently with Sender and Receiver.
+func CloseWithCode(conn *websocket.Conn, code int, reason string) error {
+	msg := websocket.FormatCloseMessage(code, reason)
+	err := conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	conn.Close()
+	return err
+}
+
 // Receiver receives data over the provided websocket.Conn.
 //
-// Measurements are read at semi-random intervals and sent over mchannel.
+// Measurements are read at semi-random intervals and delivered over
+// mchannel, along with the sender's measurements, according to its
+// DeliveryPolicy. Measurements are exchanged with the sender using the
+// negotiated encoding enc.
 //
 // The context drives how long the connection lasts. If the context is canceled
 // or there is an error, the connection and the rates channel are closed.
-func Receiver(ctx context.Context, conn *websocket.Conn, connInfo *results.ConnectionInfo, mchannel chan<- results.Measurement) error {
+func Receiver(ctx context.Context, conn *websocket.Conn, connInfo *results.ConnectionInfo, enc Encoding,
+	mchannel *Measurements) error {
 	errch := make(chan error, 1)
 	defer conn.Close()
-	go receiver(ctx, conn, connInfo, mchannel, errch)
+	go receiver(ctx, conn, connInfo, enc, mchannel, errch)
 	select {
 	case <-ctx.Done():
 		return nil
@@ -74,27 +133,24 @@ func Receiver(ctx context.Context, conn *websocket.Conn, connInfo *results.Conne
 	}
 }
 
-func receiver(ctx context.Context, conn *websocket.Conn, connInfo *results.ConnectionInfo, mchannel chan<- results.Measurement,
+func receiver(ctx context.Context, conn *websocket.Conn, connInfo *results.ConnectionInfo, enc Encoding, mchannel *Measurements,
 	errch chan<- error) {
-	defer close(mchannel)
-	fp, err := netx.GetFile(conn.UnderlyingConn())
+	defer mchannel.Close()
+	rc, err := netx.GetRawConn(conn.UnderlyingConn())
 	if err != nil {
 		errch <- err
 		return
 	}
 	numBytes := int64(0)
-	start := time.Now()
 	conn.SetReadLimit(spec.MaxScaledMessageSize)
-	ticker, err := memoryless.NewTicker(ctx, memoryless.Config{
-		Expected: spec.AvgMeasureInterval,
-		Min:      100 * time.Millisecond,
-		Max:      400 * time.Millisecond,
-	})
+	s, err := newSampler(ctx, rc, connInfo, "receiver")
 	if err != nil {
 		errch <- err
 		return
 	}
-	defer ticker.Stop()
+	defer s.stop()
+	cf := newCounterflow("sender", mchannel)
+	w := newMeasurementWriter(conn, enc, "receiver")
 	for {
 		kind, reader, err := conn.NextReader()
 		if err != nil {
@@ -102,23 +158,15 @@ func receiver(ctx context.Context, conn *websocket.Conn, connInfo *results.Conne
 			return
 		}
 		if kind == websocket.TextMessage {
-			// Text messages are sender-side measurements: read as JSON and
-			// send them over the mchannel channel.
-			data, err := ioutil.ReadAll(reader)
-			if err != nil {
-				errch <- err
-				return
-			}
+			// Text messages are sender-side measurements: validate them and
+			// deliver them over the mchannel channel.
+			n, err := cf.read(ctx, kind, reader)
 			// Make sure the message bytes are counted.
-			numBytes += int64(len(data))
-
-			// Unmarshal and send over mchannel.
-			var m results.Measurement
-			if err := json.Unmarshal(data, &m); err != nil {
+			numBytes += n
+			if err != nil {
 				errch <- err
 				return
 			}
-			mchannel <- m
 			continue
 		}
 
@@ -131,45 +179,29 @@ func receiver(ctx context.Context, conn *websocket.Conn, connInfo *results.Conne
 		numBytes += int64(n)
 
 		// Is it time to collect a measurement?
-		select {
-		case <-ticker.C:
-			appInfo := &results.AppInfo{
-				NumBytes:    int64(numBytes),
-				ElapsedTime: time.Since(start).Microseconds(),
-			}
-
-			// Get TCPInfo data.
-			tcpInfo, err := tcpinfox.GetTCPInfo(fp)
-			if err != nil && !errors.Is(err, tcpinfox.ErrNoSupport) {
-				errch <- err
-				return
-			}
-
-			// Send counterflow message.
-			m := results.Measurement{
-				AppInfo:        appInfo,
-				TCPInfo:        &results.TCPInfo{LinuxTCPInfo: *tcpInfo},
-				ConnectionInfo: connInfo,
-				Origin:         "receiver",
-			}
-
-			conn.WriteJSON(m)
-			// Send measurement over the mchannel channel.
-			mchannel <- m
-		default:
-			// NOTHING
+		if !s.ready() {
+			continue
 		}
+		m, err := s.sample(numBytes)
+		if err != nil {
+			errch <- err
+			return
+		}
+		// Send counterflow message.
+		w.write(m)
+		// Deliver measurement over the mchannel channel.
+		mchannel.deliver(ctx, m)
 	}
 }
 
 // readcounterflow reads counterflow measurement messages received on the
-// provided websocket.Conn and sends them over mchannel.
+// provided websocket.Conn and delivers them over mchannel.
 //
 // Counterflow messages are messages going against the direction of the
 // measurement (i.e. sent by the receiver).
 //
 // Errors are reported via errCh.
-func readcounterflow(wg *sync.WaitGroup, conn *websocket.Conn, mchannel chan<- results.Measurement,
+func readcounterflow(ctx context.Context, wg *sync.WaitGroup, conn *websocket.Conn, enc Encoding, mchannel *Measurements,
 	errCh chan<- error) {
 	// Notify the WaitGroup that this goroutine has completed.
 	defer wg.Done()
@@ -177,45 +209,41 @@ func readcounterflow(wg *sync.WaitGroup, conn *websocket.Conn, mchannel chan<- r
 	// Messages over MaxScaledMessageSize are ignored.
 	conn.SetReadLimit(spec.MaxScaledMessageSize)
 
+	cf := newCounterflow("receiver", mchannel)
 	for {
-		mtype, mdata, err := conn.ReadMessage()
+		mtype, reader, err := conn.NextReader()
 		if err != nil {
 			errCh <- err
 			return
 		}
-		// Ignore non-text messages from the receiver. This should never happen
-		// and is probably a sign of a bug in the client.
+		// The receiver only sends text messages, or binary ones if the CBOR
+		// encoding was negotiated. Anything else should never happen and is
+		// probably a sign of a bug in the client.
 		// TODO(roberto): add a Prometheus metric.
-		if mtype != websocket.TextMessage {
-			errCh <- errNonTextMessage
+		if mtype != websocket.TextMessage && !(mtype == websocket.BinaryMessage && enc == EncodingCBOR) {
+			errCh <- errUnexpectedMessage
 			return
 		}
 
-		// Unmarshal the Measurement and sent it over mchannel, if possible.
-		var m results.Measurement
-		if err := json.Unmarshal(mdata, &m); err != nil {
+		// Validate the Measurement and deliver it over mchannel.
+		if _, err := cf.read(ctx, mtype, reader); err != nil {
 			errCh <- err
 			return
 		}
-		select {
-		case mchannel <- m:
-		default:
-			// discard message as documented
-		}
 	}
 }
 
 // Sender sends ndt-m data over the provided websocket.Conn and spawns a
 // goroutine to process incoming counterflow messages.
 //
-// Measurements are sent to the mchannel channel. You SHOULD pass
-// to this function a channel with a reasonably large buffer (e.g.,
-// 64 slots) because the emitter will not block on sending.
+// Measurements, including the receiver's counterflow measurements, are
+// delivered over mchannel according to its DeliveryPolicy. Measurements are
+// exchanged with the receiver using the negotiated encoding enc.
 //
 // The context drives how long the connection lasts. If the context is canceled
 // or there is an error, the connection and the measurement channel are closed.
-func Sender(ctx context.Context, conn *websocket.Conn, connInfo *results.ConnectionInfo,
-	mchannel chan<- results.Measurement) error {
+func Sender(ctx context.Context, conn *websocket.Conn, connInfo *results.ConnectionInfo, enc Encoding,
+	mchannel *Measurements) error {
 	errch := make(chan error, 2)
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
@@ -224,15 +252,15 @@ func Sender(ctx context.Context, conn *websocket.Conn, connInfo *results.Connect
 		conn.Close()
 		// Make sure both goroutines are done before closing mchannel.
 		wg.Wait()
-		close(mchannel)
+		mchannel.Close()
 	}()
 
 	// Process counterflow messages
-	go readcounterflow(wg, conn, mchannel, errch)
+	go readcounterflow(ctx, wg, conn, enc, mchannel, errch)
 	zap.L().Sugar().Debug("started readcounterflow")
 
 	// Send measurement data.
-	go sender(ctx, wg, conn, connInfo, mchannel, errch)
+	go sender(ctx, wg, conn, connInfo, enc, mchannel, errch)
 	zap.L().Sugar().Debug("started sender")
 
 	// Termination: either the context is canceled or there is an error on errch.
@@ -252,22 +280,20 @@ func Sender(ctx context.Context, conn *websocket.Conn, connInfo *results.Connect
 }
 
 // sender sends binary messages and periodic measurement data over the connection
-// and measurement data over mchannel.
-func sender(ctx context.Context, wg *sync.WaitGroup, conn *websocket.Conn, connInfo *results.ConnectionInfo,
-	mchannel chan<- results.Measurement, errch chan<- error) {
+// and delivers measurement data over mchannel.
+func sender(ctx context.Context, wg *sync.WaitGroup, conn *websocket.Conn, connInfo *results.ConnectionInfo, enc Encoding,
+	mchannel *Measurements, errch chan<- error) {
 	// Notify the WaitGroup that this goroutine has completed.
 	defer wg.Done()
 
-	// Get the socket's file descriptor so measurements can be collected.
-	fp, err := netx.GetFile(conn.UnderlyingConn())
+	// Get the underlying socket so measurements can be collected.
+	rc, err := netx.GetRawConn(conn.UnderlyingConn())
 	if err != nil {
 		errch <- err
 		return
 	}
 
 	numBytes := 0
-
-	start := time.Now()
 	size := spec.MinMessageSize
 
 	message, err := makePreparedMessage(size)
@@ -276,16 +302,13 @@ func sender(ctx context.Context, wg *sync.WaitGroup, conn *websocket.Conn, connI
 		return
 	}
 
-	ticker, err := memoryless.NewTicker(ctx, memoryless.Config{
-		Min:      spec.MinMeasureInterval,
-		Expected: spec.AvgMeasureInterval,
-		Max:      spec.MaxMeasureInterval,
-	})
+	s, err := newSampler(ctx, rc, connInfo, "sender")
 	if err != nil {
 		errch <- err
 		return
 	}
-	defer ticker.Stop()
+	defer s.stop()
+	w := newMeasurementWriter(conn, enc, "sender")
 
 	// Main sender loop:
 	// - write a prepared message
@@ -306,46 +329,21 @@ func sender(ctx context.Context, wg *sync.WaitGroup, conn *websocket.Conn, connI
 
 		numBytes += size
 
-		select {
-		case <-ticker.C:
-			appInfo := &results.AppInfo{
-				ElapsedTime: int64(time.Since(start) / time.Microsecond),
-				NumBytes:    int64(numBytes),
-			}
-			tcpInfo, err := tcpinfox.GetTCPInfo(fp)
+		if s.ready() {
+			m, err := s.sample(int64(numBytes))
 			if err != nil {
 				errch <- err
 				return
 			}
-			// Get BBRInfo data, if available. Errors are not critical here.
-			bbrInfo, _ := congestion.GetBBRInfo(fp)
-
 			// Send measurement message over the network as a JSON.
-			m := results.Measurement{
-				AppInfo: appInfo,
-				TCPInfo: &results.TCPInfo{
-					LinuxTCPInfo: *tcpInfo,
-					ElapsedTime:  appInfo.ElapsedTime,
-				},
-				BBRInfo:        &results.BBRInfo{BBRInfo: bbrInfo},
-				ConnectionInfo: connInfo,
-				Origin:         "sender",
-			}
-			err = conn.WriteJSON(m)
+			err = w.write(m)
 
-			// Send the measurement over mchannel if possible. Do not block.
-			select {
-			case mchannel <- m:
-			default:
-				// discard message
-			}
+			mchannel.deliver(ctx, m)
 
 			if err != nil {
 				errch <- err
 				return
 			}
-		default:
-			// NOTHING
 		}
 
 		// Is it time to scale the message size?
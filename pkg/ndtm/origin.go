@@ -0,0 +1,91 @@
+package ndtm
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrOriginNotAllowed is returned by Upgrade if the request's Origin is
+// rejected by the OriginPolicy.
+var ErrOriginNotAllowed = errors.New("origin not allowed")
+
+// OriginPolicy decides which browser origins can open WebSocket connections.
+// Requests without an Origin header (i.e. from non-browser clients) are
+// always allowed. A nil *OriginPolicy allows all origins.
+type OriginPolicy struct {
+	allowAll bool
+	patterns []originPattern
+}
+
+// originPattern matches origins with the given scheme (any if empty) and
+// host. If wildcard is true, host is a suffix that origins must have.
+type originPattern struct {
+	scheme   string
+	host     string
+	wildcard bool
+}
+
+// NewOriginPolicy returns an OriginPolicy allowing the origins matching any
+// of the given patterns. A pattern can be:
+//
+//   - "*", allowing all origins;
+//   - an origin, e.g. "https://example.com" or "http://localhost:8000";
+//   - a host, e.g. "example.com", allowing it with any scheme;
+//   - a wildcard domain, e.g. "*.example.com" or "https://*.example.com",
+//     allowing all its subdomains but not the domain itself.
+//
+// An empty list of patterns allows all origins.
+func NewOriginPolicy(patterns []string) (*OriginPolicy, error) {
+	p := &OriginPolicy{
+		allowAll: len(patterns) == 0,
+	}
+	for _, s := range patterns {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if s == "*" {
+			p.allowAll = true
+			continue
+		}
+		var op originPattern
+		host := s
+		if i := strings.Index(s, "://"); i >= 0 {
+			op.scheme, host = s[:i], s[i+3:]
+		}
+		if strings.HasPrefix(host, "*.") {
+			op.wildcard = true
+			host = host[1:]
+		}
+		if host == "" || host == "." || strings.ContainsAny(host, "/*?#") {
+			return nil, fmt.Errorf("invalid origin pattern %q", s)
+		}
+		op.host = host
+		p.patterns = append(p.patterns, op)
+	}
+	return p, nil
+}
+
+// Allowed returns whether the origin of r is allowed.
+func (p *OriginPolicy) Allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if p == nil || p.allowAll || origin == "" {
+		return true
+	}
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil {
+		return false
+	}
+	for _, op := range p.patterns {
+		if op.scheme != "" && op.scheme != u.Scheme {
+			continue
+		}
+		if op.wildcard && strings.HasSuffix(u.Hostname(), op.host) {
+			return true
+		}
+		if !op.wildcard && op.host == u.Host {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,8 @@
 package results
 
 import (
+	"crypto/tls"
+	"fmt"
 	"time"
 
 	"github.com/m-lab/tcp-info/inetdiag"
@@ -20,32 +22,219 @@ type NDTMResult struct {
 	MeasurementID string
 	// UUID is the unique ID for this TCP flow.
 	UUID string
+	// PeerUUID is the unique ID for this TCP flow on the other endpoint,
+	// i.e. the UUID of the matching result archived by the peer.
+	PeerUUID string `json:",omitempty"`
 	// StartTime is the time when the flow started. It does not include the
 	// connection setup time.
 	StartTime time.Time
 	// EndTime is the time when the flow ended.
 	EndTime time.Time
-	// CongestionControl is the congestion control algorithm used by the flow.
+	// CongestionControl is the congestion control algorithm used by the flow
+	// on the endpoint that wrote this result.
 	CongestionControl string
+	// ClientCongestionControl is the congestion control algorithm used by
+	// the client's socket. It is only set in the server's results, which
+	// learns it from the client's measurements: in the client's results,
+	// it is CongestionControl.
+	ClientCongestionControl string `json:",omitempty"`
+	// ServerCongestionControl is the congestion control algorithm used by
+	// the server's socket. It is only set in the client's results, which
+	// learns it from the server's measurements: in the server's results,
+	// it is CongestionControl.
+	ServerCongestionControl string `json:",omitempty"`
+	// RequestedCongestionControl is the comma-separated list of congestion
+	// control algorithms requested by the client, in order of preference.
+	RequestedCongestionControl string `json:",omitempty"`
 	// SubTest is the subtest of the measurement (download or upload)
 	SubTest string
+	// TLS contains the parameters negotiated for the TLS connection, if any.
+	TLS *TLSInfo `json:",omitempty"`
+	// Identity is the identity the client authenticated with, if any.
+	Identity *Identity `json:",omitempty"`
+	// ClockSync is the estimate of the offset between the client's and the
+	// server's clocks, made at the beginning of the flow.
+	ClockSync *ClockSync `json:",omitempty"`
+	// ClockSyncError is why the clock offset estimation requested by the
+	// client failed, if it did. The flow is then interrupted before the
+	// measurement starts, and ClockSync is nil.
+	ClockSyncError string `json:",omitempty"`
+	// DroppedMeasurements is the number of measurements, by origin
+	// ("sender" or "receiver"), that this endpoint could not record because
+	// its measurement buffer was full. When non-zero, the corresponding
+	// series are incomplete.
+	DroppedMeasurements map[string]int64 `json:",omitempty"`
+	// InvalidMeasurements is the number of measurements received from the
+	// peer that were discarded, by reason (one of the Invalid* constants).
+	InvalidMeasurements map[string]int64 `json:",omitempty"`
+	// ByteDivergence compares the bytes counted by the sender and the
+	// receiver over the flow, to detect middleboxes. It is nil if there
+	// were not enough measurements to compare.
+	ByteDivergence *ByteDivergence `json:",omitempty"`
 	// ServerMeasurements is a list of measurements taken by the server.
 	ServerMeasurements []Measurement
 	// ClientMeasurements is a list of measurements taken by the client.
 	ClientMeasurements []Measurement
 }
 
+// TLSInfo contains the parameters negotiated for a TLS connection.
+type TLSInfo struct {
+	// Version is the TLS version, e.g. "TLS 1.3".
+	Version string
+	// CipherSuite is the IANA name of the cipher suite.
+	CipherSuite string
+	// ServerName is the server name requested by the client via SNI.
+	ServerName string `json:",omitempty"`
+	// ALPN is the application protocol negotiated via ALPN, if any.
+	ALPN string `json:",omitempty"`
+}
+
+// ByteDivergence compares, at the times the receiver took its measurements,
+// the bytes counted by the sender with the bytes counted by the receiver.
+// Without middleboxes, the bytes sent by the sender's kernel can only lead by
+// the data in flight and in the receiver's socket buffer, and no byte can be
+// acknowledged to the sender before the receiver gets it.
+type ByteDivergence struct {
+	// Samples is the number of receiver measurements compared.
+	Samples int
+	// SenderLead is the median of the difference between the sender's and
+	// the receiver's AppInfo.NumBytes, relative to the sender's. It
+	// includes the data in the sender's socket buffer, which can be large.
+	SenderLead float64
+	// MaxSenderLead is the maximum difference between the sender's and the
+	// receiver's AppInfo.NumBytes, in bytes.
+	MaxSenderLead int64
+	// SentLead is the median of the difference between the bytes sent by
+	// the sender's kernel (TCPInfo.BytesSent minus TCPInfo.BytesRetrans)
+	// and the receiver's AppInfo.NumBytes, relative to the former. It is
+	// zero if the sender's TCPInfo is unavailable.
+	SentLead float64
+	// AckedLead is the median of the difference between the sender's
+	// TCPInfo.BytesAcked and the receiver's AppInfo.NumBytes, relative to
+	// the receiver's. It is zero if the sender's TCPInfo is unavailable.
+	AckedLead float64
+	// Buffering is true if SentLead is above 0.5, i.e. the receiver had
+	// usually read less than half the bytes sent by the sender's kernel,
+	// which suggests a buffering middlebox.
+	Buffering bool
+	// Proxying is true if AckedLead is above 0.1, i.e. bytes were usually
+	// acknowledged to the sender before the receiver got them, which
+	// suggests a transparent TCP proxy.
+	Proxying bool
+}
+
+// ClockSync is an NTP-style estimate of the offset between the client's and
+// the server's clocks. Adding Offset to a client's timestamp gives the
+// corresponding time on the server's clock.
+type ClockSync struct {
+	// Offset is the server's clock minus the client's clock, in
+	// microseconds.
+	Offset int64
+	// RTT is the round-trip time of the sample the estimate is based on,
+	// i.e. the one with the lowest RTT, in microseconds.
+	RTT int64
+	// Samples are all the exchanges made, in order.
+	Samples []ClockSample
+}
+
+// ClockSample is a single exchange of a clock offset estimation. All the
+// timestamps are in microseconds since the Unix epoch, each according to the
+// clock of the endpoint taking it.
+type ClockSample struct {
+	ClientSend    int64
+	ServerReceive int64
+	ServerSend    int64
+	ClientReceive int64
+}
+
+// Offset returns the clock offset estimated by s, in microseconds.
+func (s ClockSample) Offset() int64 {
+	return ((s.ServerReceive - s.ClientSend) + (s.ServerSend - s.ClientReceive)) / 2
+}
+
+// RTT returns the round-trip time measured by s, excluding the time spent by
+// the server, in microseconds.
+func (s ClockSample) RTT() int64 {
+	return (s.ClientReceive - s.ClientSend) - (s.ServerSend - s.ServerReceive)
+}
+
+// Identity describes an authenticated client.
+type Identity struct {
+	// Method is the authentication method: "token", "mtls", "apikey" or
+	// "hmac".
+	Method string
+	// Subject identifies the client within the method, e.g. the subject of
+	// its certificate or the name of its key.
+	Subject string
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// NewTLSInfo returns the TLSInfo for the given connection state.
+func NewTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	version, ok := tlsVersions[state.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04X", state.Version)
+	}
+	return &TLSInfo{
+		Version:     version,
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+		ALPN:        state.NegotiatedProtocol,
+	}
+}
+
 // The Measurement struct contains measurement results. This structure is
 // meant to be serialised as JSON as sent as a textual message. This
 // structure is specified in the ndt7 specification.
 type Measurement struct {
+	// Timestamp is the wall-clock time at which the measurement was taken,
+	// according to the clock of the endpoint taking it.
+	Timestamp      time.Time       `json:",omitempty"`
 	AppInfo        *AppInfo        `json:",omitempty"`
 	ConnectionInfo *ConnectionInfo `json:",omitempty" bigquery:"-"`
 	BBRInfo        *BBRInfo        `json:",omitempty"`
+	CCInfo         *CCInfo         `json:",omitempty"`
 	TCPInfo        *TCPInfo        `json:",omitempty"`
 	Origin         string          `json:",omitempty"`
+	// Unavailable lists the data that could not be collected for this
+	// measurement (e.g. TCPInfo on systems without TCP_INFO), which is
+	// omitted rather than zero-filled.
+	Unavailable []string `json:",omitempty"`
 }
 
+// Reasons for discarding a measurement received from the peer, as counted in
+// NDTMResult.InvalidMeasurements.
+const (
+	// InvalidTooLarge is for messages larger than the maximum size.
+	InvalidTooLarge = "too_large"
+	// InvalidRate is for messages exceeding the maximum rate.
+	InvalidRate = "rate"
+	// InvalidCount is for messages exceeding the maximum number per flow.
+	InvalidCount = "count"
+	// InvalidMalformed is for messages that are not a valid Measurement.
+	InvalidMalformed = "malformed"
+	// InvalidOrigin is for measurements not taken by the peer's role.
+	InvalidOrigin = "origin"
+	// InvalidElapsedTime is for measurements without AppInfo, or whose
+	// ElapsedTime is out of range or not greater than the previous one.
+	InvalidElapsedTime = "elapsed_time"
+	// InvalidNumBytes is for measurements whose NumBytes is negative,
+	// lower than the previous one or implies an implausible throughput.
+	InvalidNumBytes = "num_bytes"
+)
+
+// Values of Measurement.Unavailable.
+const (
+	UnavailableTCPInfo = "TCPInfo"
+	UnavailableCCInfo  = "CCInfo"
+)
+
 // AppInfo contains an application level measurement. This structure is
 // described in the ndt7 specification.
 type AppInfo struct {
@@ -56,11 +245,20 @@ type AppInfo struct {
 // ConnectionInfo contains connection info. This structure is described
 // in the ndt7 specification.
 type ConnectionInfo struct {
+	// Client and Server are the client's and server's address and port.
 	Client string
 	Server string
 	UUID   string `json:",omitempty"`
 	// CC is the congestion algorithm used by the sender of this struct.
 	CC string
+	// Family is the IP family of the connection ("ipv4" or "ipv6").
+	Family string `json:",omitempty"`
+	// PathMTU is the path MTU measured by the sender of this struct.
+	PathMTU uint32 `json:",omitempty"`
+	// TLS contains the parameters negotiated for the TLS connection, if any.
+	TLS *TLSInfo `json:",omitempty"`
+	// Extensions lists the WebSocket extensions negotiated, if any.
+	Extensions []string `json:",omitempty"`
 }
 
 // The BBRInfo struct contains information measured using BBR. This structure is
@@ -71,6 +269,22 @@ type BBRInfo struct {
 	ElapsedTime int64
 }
 
+// The CCInfo struct contains information exported by the congestion control
+// algorithm via TCP_CC_INFO. Only the field matching Algorithm is set, and
+// none of them is set for algorithms that do not export any information (e.g.
+// CUBIC). Variables here have the same measurement unit that is used by the
+// Linux kernel.
+type CCInfo struct {
+	// Algorithm is the congestion control algorithm used by the socket.
+	Algorithm string
+	BBR       *inetdiag.BBRInfo   `json:",omitempty"`
+	Vegas     *inetdiag.VegasInfo `json:",omitempty"`
+	DCTCP     *inetdiag.DCTCPInfo `json:",omitempty"`
+	// ElapsedTime is the time elapsed since the beginning of the flow, in
+	// microseconds.
+	ElapsedTime int64
+}
+
 // The TCPInfo struct contains information measured using TCP_INFO. This
 // structure is described in the ndt7 specification.
 type TCPInfo struct {
@@ -0,0 +1,124 @@
+package ndtm
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/m-lab/go/memoryless"
+	"github.com/robertodauria/msak/internal/tcpinfox"
+	"github.com/robertodauria/msak/pkg/ndtm/results"
+	"github.com/robertodauria/msak/pkg/ndtm/spec"
+)
+
+// sampler builds the Measurements taken on a connection at memoryless
+// intervals. It is used by both the sender and the receiver, so that
+// measurements have the same content regardless of the flow's role.
+type sampler struct {
+	rc       syscall.RawConn
+	connInfo *results.ConnectionInfo
+	origin   string
+	start    time.Time
+
+	ticker *memoryless.Ticker
+	// due is signaled when it is time to take a measurement.
+	due chan struct{}
+}
+
+// newSampler returns a sampler for the connection rc whose measurements are
+// tagged with origin ("sender" or "receiver"). Elapsed times are relative to
+// the time newSampler is called. The sampler must be stopped with stop.
+func newSampler(ctx context.Context, rc syscall.RawConn, connInfo *results.ConnectionInfo,
+	origin string) (*sampler, error) {
+	ticker, err := memoryless.NewTicker(ctx, memoryless.Config{
+		Min:      spec.MinMeasureInterval,
+		Expected: spec.AvgMeasureInterval,
+		Max:      spec.MaxMeasureInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := &sampler{
+		rc:       rc,
+		connInfo: connInfo,
+		origin:   origin,
+		start:    time.Now(),
+		ticker:   ticker,
+		due:      make(chan struct{}, 1),
+	}
+	// The ticker does not block when sending ticks, so a tick is lost unless
+	// someone is receiving at that very moment. Since the sender and the
+	// receiver only poll for ticks between messages, keep the last tick
+	// until it is consumed by due.
+	go func() {
+		for range ticker.C {
+			select {
+			case s.due <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return s, nil
+}
+
+// ready returns whether it is time to take a measurement. It does not block.
+func (s *sampler) ready() bool {
+	select {
+	case <-s.due:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops the sampler's ticker.
+func (s *sampler) stop() {
+	s.ticker.Stop()
+}
+
+// sample takes a measurement, given the number of bytes transferred by the
+// application so far. Data that cannot be collected on this system is
+// omitted and listed in the measurement's Unavailable field.
+func (s *sampler) sample(numBytes int64) (results.Measurement, error) {
+	now := time.Now()
+	elapsed := now.Sub(s.start).Microseconds()
+	m := results.Measurement{
+		Timestamp: now.UTC(),
+		AppInfo: &results.AppInfo{
+			NumBytes:    numBytes,
+			ElapsedTime: elapsed,
+		},
+		ConnectionInfo: s.connInfo,
+		Origin:         s.origin,
+	}
+
+	tcpInfo, err := tcpinfox.GetTCPInfo(s.rc)
+	switch {
+	case errors.Is(err, tcpinfox.ErrNoSupport):
+		m.Unavailable = append(m.Unavailable, results.UnavailableTCPInfo)
+	case err != nil:
+		return results.Measurement{}, err
+	default:
+		m.TCPInfo = &results.TCPInfo{
+			LinuxTCPInfo: *tcpInfo,
+			ElapsedTime:  elapsed,
+		}
+	}
+
+	// Errors reading TCP_CC_INFO are not critical.
+	ccInfo, err := getCCInfo(s.rc, elapsed)
+	if err != nil {
+		m.Unavailable = append(m.Unavailable, results.UnavailableCCInfo)
+		return m, nil
+	}
+	m.CCInfo = ccInfo
+	// BBRInfo is only set when the flow is actually running BBR.
+	if ccInfo.BBR != nil {
+		m.BBRInfo = &results.BBRInfo{
+			BBRInfo:     *ccInfo.BBR,
+			ElapsedTime: elapsed,
+		}
+	}
+	return m, nil
+}
@@ -42,8 +42,91 @@ const (
 	// MaxRuntime is the maximum runtime of a subtest.
 	MaxRuntime = 15 * time.Second
 
+	// RuntimeGrace is how long past MaxRuntime a server lets a subtest run
+	// before interrupting it. It covers the setup that precedes the
+	// measurement (e.g. the clock offset estimation) and the closing
+	// handshake, so that subtests lasting MaxRuntime can complete.
+	RuntimeGrace = 3 * time.Second
+
+	// MaxCounterflowMessageSize is the maximum size of a measurement
+	// (textual) message received from the peer. Larger messages are
+	// discarded.
+	MaxCounterflowMessageSize = 1 << 14
+
+	// MaxCounterflowRate is the maximum number of measurement messages
+	// accepted from the peer in each second of a flow.
+	MaxCounterflowRate = 2 * int(time.Second/MinMeasureInterval)
+
+	// MaxCounterflowMessages is the maximum number of measurement messages
+	// accepted from the peer over a flow.
+	MaxCounterflowMessages = 2 * int(MaxRuntime/MinMeasureInterval)
+
+	// MaxPlausibleRate is the highest throughput, in bits per second, that a
+	// measurement received from the peer can report.
+	MaxPlausibleRate = 1e12
+
 	// SecWebSocketProtocol is the value of the Sec-WebSocket-Protocol header.
 	SecWebSocketProtocol = "net.measurementlab.ndt.m"
+
+	// AvailableCCHeader is the HTTP header listing the congestion control
+	// algorithms accepted by the server. It is sent when a request is
+	// rejected because none of the requested algorithms is allowed.
+	AvailableCCHeader = "X-Msak-Available-CC"
+
+	// EncodingParam is the querystring parameter with which clients request
+	// an encoding for measurement messages other than JSON.
+	EncodingParam = "encoding"
+
+	// EncodingHeader is the HTTP header with which the server confirms the
+	// encoding of measurement messages requested by the client.
+	EncodingHeader = "X-Msak-Encoding"
+
+	// ClockSyncParam is the querystring parameter with which clients ask for
+	// a clock offset estimation at the beginning of the flow. Its value is the
+	// number of exchanges, at most MaxClockSyncSamples.
+	ClockSyncParam = "clock_sync"
+
+	// ClockSyncHeader is the HTTP header with which the server confirms the
+	// number of clock offset estimation exchanges it will answer. Clients
+	// must not start the estimation without it.
+	ClockSyncHeader = "X-Msak-Clock-Sync"
+
+	// DefaultClockSyncSamples is the number of clock offset estimation
+	// exchanges made by default.
+	DefaultClockSyncSamples = 5
+
+	// MaxClockSyncSamples is the maximum number of clock offset estimation
+	// exchanges.
+	MaxClockSyncSamples = 10
+
+	// UUIDHeader is the HTTP header carrying the server's UUID for the TCP
+	// flow in the WebSocket upgrade response.
+	UUIDHeader = "X-Msak-UUID"
+)
+
+// Close codes sent by ndt-m servers when a measurement cannot start or has to
+// be interrupted, in the range reserved for private use by RFC 6455. Each is
+// sent with the corresponding reason below.
+const (
+	// CloseUnsupportedCC means the requested congestion control algorithm
+	// could not be set on the connection.
+	CloseUnsupportedCC = 4000
+	// CloseServerOverloaded means the server is running too many
+	// measurements already.
+	CloseServerOverloaded = 4001
+	// CloseDurationExceeded means the measurement lasted more than
+	// MaxRuntime, plus RuntimeGrace.
+	CloseDurationExceeded = 4002
+	// CloseInternalError means the server failed to set up the measurement.
+	CloseInternalError = 4003
+)
+
+// Reasons sent along with the close codes.
+const (
+	ReasonUnsupportedCC    = "unsupported congestion control algorithm"
+	ReasonServerOverloaded = "server overloaded"
+	ReasonDurationExceeded = "maximum duration exceeded"
+	ReasonInternalError    = "internal server error"
 )
 
 // SubtestKind indicates the subtest kind
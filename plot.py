@@ -20,6 +20,15 @@ def get_json_by_mid(folder, mid):
                 res.append(data)
     return res
 
+def aligned_timestamp(result, m):
+    """Returns the Timestamp of the client measurement m on the server's clock,
+    using the clock offset estimated for the flow, if any."""
+    ts = parser.parse(m.get("Timestamp"))
+    clock_sync = result.get("ClockSync")
+    if clock_sync:
+        ts += datetime.timedelta(microseconds=clock_sync.get("Offset"))
+    return ts
+
 def main():
     if len(sys.argv) < 3:
        print("Usage: {} <input folder> <measurement id>".format(sys.argv[0]))
@@ -31,19 +40,31 @@ def main():
 
     start_times = [parser.parse(file.get("StartTime")) for file in json_data]
     global_start_time = min(start_times)
+    # When measurements have timestamps, they are moved to the server's clock
+    # and the plot starts when the first flow did, on the same clock.
+    flow_starts = [
+        aligned_timestamp(file, m) -
+        datetime.timedelta(microseconds=m.get("AppInfo").get("ElapsedTime"))
+        for file in json_data
+        for m in file.get("ClientMeasurements") or []
+        if m.get("Timestamp")
+    ]
+    global_aligned_start = min(flow_starts) if flow_starts else None
 
     plot_data = {}
     for idx, file in enumerate(json_data):
         x_values, y_values = [], []
         start_time = parser.parse(file.get("StartTime"))
-        start_time_offset = start_time - global_start_time
-        print("flow #{} time offset: {} us".format(idx, start_time_offset.microseconds))
+        start_time_offset = (start_time - global_start_time).total_seconds()
+        print("flow #{} time offset: {} s".format(idx, start_time_offset))
         measurements = file.get("ClientMeasurements")
         previous = None
         for m in measurements:
             elapsed_sec = m.get("AppInfo").get("ElapsedTime") / 1000000
-            rate_mbps = m.get("AppInfo").get("NumBytes") / elapsed_sec / 1000000 * 8
-            time = elapsed_sec + start_time_offset.microseconds / 1000000
+            if m.get("Timestamp") and global_aligned_start is not None:
+                time = (aligned_timestamp(file, m) - global_aligned_start).total_seconds()
+            else:
+                time = elapsed_sec + start_time_offset
             if previous is not None:
                 dtime = m.get("AppInfo").get("ElapsedTime") - previous.get("AppInfo").get("ElapsedTime")
                 dbytes = m.get("AppInfo").get("NumBytes") - previous.get("AppInfo").get("NumBytes")